@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Traffic is counted per remote (encrypted datagrams) and per route (inner
+// packets), counters are kept in state file (main.accountingFile) between
+// restarts. When traffic of remote exceeds its quota event is logged, hook
+// script is started and remote is optionally blocked.
+
+const (
+	quotaActionLog   = "log"
+	quotaActionBlock = "block"
+
+	// accountingSaveInterval is period of writing state file
+	accountingSaveInterval = time.Minute
+
+	// quotaCheckInterval is period of quota checks
+	quotaCheckInterval = 10 * time.Second
+)
+
+// acctCounters contains traffic counters of remote or route
+type acctCounters struct {
+	BytesIn    uint64 `json:"bytesIn"`
+	BytesOut   uint64 `json:"bytesOut"`
+	PacketsIn  uint64 `json:"packetsIn"`
+	PacketsOut uint64 `json:"packetsOut"`
+
+	exceeded int32
+	blocked  int32
+}
+
+func (a *acctCounters) addIn(n int) {
+	atomic.AddUint64(&a.BytesIn, uint64(n))
+	atomic.AddUint64(&a.PacketsIn, 1)
+}
+
+func (a *acctCounters) addOut(n int) {
+	atomic.AddUint64(&a.BytesOut, uint64(n))
+	atomic.AddUint64(&a.PacketsOut, 1)
+}
+
+func (a *acctCounters) isBlocked() bool {
+	return 0 != atomic.LoadInt32(&a.blocked)
+}
+
+// add adds counters loaded from state file
+func (a *acctCounters) add(l *acctCounters) {
+	atomic.AddUint64(&a.BytesIn, l.BytesIn)
+	atomic.AddUint64(&a.BytesOut, l.BytesOut)
+	atomic.AddUint64(&a.PacketsIn, l.PacketsIn)
+	atomic.AddUint64(&a.PacketsOut, l.PacketsOut)
+}
+
+// snapshot returns copy of counters for saving
+func (a *acctCounters) snapshot() *acctCounters {
+	return &acctCounters{
+		BytesIn:    atomic.LoadUint64(&a.BytesIn),
+		BytesOut:   atomic.LoadUint64(&a.BytesOut),
+		PacketsIn:  atomic.LoadUint64(&a.PacketsIn),
+		PacketsOut: atomic.LoadUint64(&a.PacketsOut),
+	}
+}
+
+// acctState is content of state file
+type acctState struct {
+	Saved  time.Time                `json:"saved"`
+	Peers  map[string]*acctCounters `json:"peers"`
+	Routes map[string]*acctCounters `json:"routes"`
+}
+
+// accounting contains counters kept between config reloads
+var accounting = struct {
+	sync.Mutex
+	acctState
+}{acctState: acctState{
+	Peers:  map[string]*acctCounters{},
+	Routes: map[string]*acctCounters{},
+}}
+
+func getAcct(m map[string]*acctCounters, name string) *acctCounters {
+	accounting.Lock()
+	defer accounting.Unlock()
+
+	a, ok := m[name]
+	if !ok {
+		a = &acctCounters{}
+		m[name] = a
+	}
+	return a
+}
+
+// peerAcct returns counters of remote name
+func peerAcct(name string) *acctCounters {
+	return getAcct(accounting.Peers, name)
+}
+
+// routeAcct returns counters of route
+func routeAcct(route *net.IPNet) *acctCounters {
+	return getAcct(accounting.Routes, route.String())
+}
+
+// acctRoute is route of remote with its counters
+type acctRoute struct {
+	net  *net.IPNet
+	acct *acctCounters
+}
+
+// parseSize parses size like "100GB", "512MB" or number of bytes
+func parseSize(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if "" == s {
+		return 0, nil
+	}
+	mult := uint64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   uint64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if nil != err {
+		return 0, err
+	}
+	if 0 == n {
+		return 0, errors.New("size must be positive")
+	}
+	return n * mult, nil
+}
+
+// validQuotaAction returns true if action is known quota action
+func validQuotaAction(action string) bool {
+	switch action {
+	case "", quotaActionLog, quotaActionBlock:
+		return true
+	}
+	return false
+}
+
+// peerFrom returns settings of remote which sent datagram
+func (c *VPNState) peerFrom(from net.Addr) *peerInfo {
+	if addr, ok := from.(*net.UDPAddr); ok {
+		return c.peers[addr]
+	}
+	return nil
+}
+
+// accountIncoming counts received packet in routes of remote
+func (p *peerInfo) accountIncoming(packet IPPacket, size int) {
+	if 0 == len(p.routes) || msgIPv4 != msgType(packet) {
+		return
+	}
+	src := net.IP(packet[12:16])
+	for _, r := range p.routes {
+		if r.net.Contains(src) {
+			r.acct.addIn(size)
+			return
+		}
+	}
+}
+
+// loadAccounting reads counters from state file
+func loadAccounting(file string) error {
+	f, err := os.Open(file)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var state acctState
+	if err := json.NewDecoder(f).Decode(&state); nil != err {
+		return fmt.Errorf("accounting file %s: %s", file, err)
+	}
+
+	for name, a := range state.Peers {
+		peerAcct(name).add(a)
+	}
+	for name, a := range state.Routes {
+		getAcct(accounting.Routes, name).add(a)
+	}
+	return nil
+}
+
+// saveAccounting writes counters to state file (via temporary file)
+func saveAccounting(file string) error {
+	state := acctState{
+		Saved:  time.Now(),
+		Peers:  map[string]*acctCounters{},
+		Routes: map[string]*acctCounters{},
+	}
+	accounting.Lock()
+	for name, a := range accounting.Peers {
+		state.Peers[name] = a.snapshot()
+	}
+	for name, a := range accounting.Routes {
+		state.Routes[name] = a.snapshot()
+	}
+	accounting.Unlock()
+
+	return saveJSON(file, &state)
+}
+
+// saveJSON writes v as JSON to file via temporary file, so file is never
+// left partially written
+func saveJSON(file string, v interface{}) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if nil != err {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(v); nil == err {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if nil == err {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if nil != err {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// checkQuotas logs, runs hook and blocks remotes which exceeded quota,
+// remote is unblocked when quota is raised
+func checkQuotas(c *VPNState) {
+	for _, p := range c.peers {
+		a := p.acct
+		total := atomic.LoadUint64(&a.BytesIn) + atomic.LoadUint64(&a.BytesOut)
+		exceeded := p.quota > 0 && total > p.quota
+
+		blocked := int32(0)
+		if exceeded && quotaActionBlock == p.quotaAction {
+			blocked = 1
+		}
+		if atomic.SwapInt32(&a.blocked, blocked) != blocked {
+			if 0 != blocked {
+				log.Println("Remote", p.name, "is blocked")
+			} else {
+				log.Println("Remote", p.name, "is unblocked")
+			}
+		}
+
+		if !exceeded {
+			atomic.StoreInt32(&a.exceeded, 0)
+			continue
+		}
+		if !atomic.CompareAndSwapInt32(&a.exceeded, 0, 1) {
+			continue
+		}
+
+		log.Printf("Remote %s exceeded quota: %d of %d bytes\n", p.name, total, p.quota)
+		if "" != c.Main.QuotaHook {
+			go runQuotaHook(c.Main.QuotaHook, p.name, total, p.quota)
+		}
+	}
+}
+
+func runQuotaHook(hook, name string, total, quota uint64) {
+	out, err := exec.Command(hook, name,
+		strconv.FormatUint(total, 10), strconv.FormatUint(quota, 10)).CombinedOutput()
+	if nil != err {
+		log.Printf("Quota hook for %s failed: %s %s\n", name, err, out)
+	}
+}
+
+// accountingThread saves counters periodically and checks quotas
+func accountingThread() {
+	save := time.NewTicker(accountingSaveInterval)
+	check := time.NewTicker(quotaCheckInterval)
+	for {
+		select {
+		case <-save.C:
+			c := config.Load().(VPNState)
+			if "" != c.Main.AccountingFile {
+				if err := saveAccounting(c.Main.AccountingFile); nil != err {
+					log.Println("Unable to save accounting:", err)
+				}
+			}
+		case <-check.C:
+			c := config.Load().(VPNState)
+			checkQuotas(&c)
+		}
+	}
+}
+
+// printAccounting prints counters from state file as table
+func printAccounting(w io.Writer, file string) error {
+	if err := loadAccounting(file); nil != err {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\tbytes in\tbytes out\tpackets in\tpackets out\t")
+	for _, group := range []map[string]*acctCounters{accounting.Peers, accounting.Routes} {
+		names := make([]string, 0, len(group))
+		for name := range group {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			a := group[name]
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t\n", name,
+				a.BytesIn, a.BytesOut, a.PacketsIn, a.PacketsOut)
+		}
+	}
+	return tw.Flush()
+}
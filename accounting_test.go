@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		quota   string
+		want    uint64
+		wantErr bool
+	}{
+		{quota: "", want: 0},
+		{quota: "1000", want: 1000},
+		{quota: "512MB", want: 512 << 20},
+		{quota: "100 gb", want: 100 << 30},
+		{quota: "2TB", want: 2 << 40},
+		{quota: "0GB", wantErr: true},
+		{quota: "lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.quota, func(t *testing.T) {
+			got, err := parseSize(tt.quota)
+			if (nil != err) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize(%q) = %d, want %d", tt.quota, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccountingState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "accounting.json")
+
+	a := peerAcct("test-save")
+	a.addIn(100)
+	a.addOut(200)
+	a.addOut(300)
+	if err := saveAccounting(file); nil != err {
+		t.Fatal(err)
+	}
+
+	// loaded counters are added to current ones
+	if err := loadAccounting(file); nil != err {
+		t.Fatal(err)
+	}
+	if 200 != a.BytesIn || 1000 != a.BytesOut || 4 != a.PacketsOut {
+		t.Fatalf("counters after load: %+v", a.snapshot())
+	}
+
+	var out bytes.Buffer
+	if err := printAccounting(&out, file); nil != err {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "test-save") {
+		t.Fatalf("remote is missing in output:\n%s", out.String())
+	}
+}
+
+func TestCheckQuotas(t *testing.T) {
+	p := &peerInfo{name: "test-quota", acct: peerAcct("test-quota"),
+		quota: 1000, quotaAction: quotaActionBlock}
+	c := &VPNState{peers: map[*net.UDPAddr]*peerInfo{{}: p}}
+
+	p.acct.addOut(999)
+	checkQuotas(c)
+	if p.acct.isBlocked() {
+		t.Fatal("blocked before quota is exceeded")
+	}
+
+	p.acct.addIn(2)
+	checkQuotas(c)
+	if !p.acct.isBlocked() {
+		t.Fatal("not blocked after quota is exceeded")
+	}
+
+	p.quota = 2000
+	checkQuotas(c)
+	if p.acct.isBlocked() {
+		t.Fatal("still blocked after quota is raised")
+	}
+}
+
+func TestForgedNotAccounted(t *testing.T) {
+	e, err := registeredEncrypters["aescbchmac"]("4A34E352D7C32FC42F1CEB0CAA54D40E9D1EEDAF14EBCBCECA429E1B2EF72D214A34E352D7C32FC42F1CEB0CAA54D40E")
+	if nil != err {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 23456}
+	p := &peerInfo{name: "test-forged", acct: &acctCounters{}}
+	c := &VPNState{
+		peers:      map[*net.UDPAddr]*peerInfo{addr: p},
+		extRemotes: map[[4]byte]*net.UDPAddr{{192, 0, 2, 1}: addr},
+	}
+	c.Main.main = e
+
+	forged := make([]byte, 2*e.IVLen()+64)
+	if _, ok := decryptIncoming(c, addr, forged, make(IPPacket, BUFFERSIZE)); ok {
+		t.Fatal("forged datagram accepted")
+	}
+	if 0 != p.acct.PacketsIn || 0 != p.acct.BytesIn {
+		t.Errorf("forged datagram accounted: %d packets, %d bytes", p.acct.PacketsIn, p.acct.BytesIn)
+	}
+}
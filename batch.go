@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+)
+
+// rcvrBatchLoop receives up to batch datagrams per syscall (recvmmsg on linux)
+func rcvrBatchLoop(conn net.PacketConn, iface tunIface, batch int) {
+	pc := ipv4.NewPacketConn(conn)
+
+	msgs := make([]ipv4.Message, batch)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, BUFFERSIZE)}
+	}
+	var decrypted IPPacket = make([]byte, BUFFERSIZE)
+
+	for {
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Error: ", err)
+			continue
+		}
+
+		// one config for whole batch
+		conf := config.Load().(VPNState)
+
+		for i := 0; i < n; i++ {
+			if 0 == msgs[i].N {
+				continue
+			}
+			handleIncoming(&conf, msgs[i].Addr, msgs[i].Buffers[0][:msgs[i].N], decrypted, iface)
+		}
+
+		// coalesced segments are written once per batch
+		flushIface(iface)
+	}
+}
+
+// sndrBatchLoop collects packets from local interface while they are ready,
+// encrypts them together and sends up to batch datagrams per syscall
+// (sendmmsg on linux)
+func sndrBatchLoop(conn *net.UDPConn, iface tunIface, batch int, stop *atomic.Bool) {
+	// first time fill with random numbers
+	ivbuf := make([]byte, config.Load().(VPNState).Main.main.IVLen())
+	if _, err := io.ReadFull(rand.Reader, ivbuf); err != nil {
+		log.Fatalln("Unable to get rand data:", err)
+	}
+
+	// TUN read is blocking, so it's done by separate goroutine and
+	// buffers are returned back via free channel
+	packets := make(chan IPPacket, batch)
+	free := make(chan IPPacket, batch+1)
+	for i := 0; i < batch+1; i++ {
+		free <- make([]byte, BUFFERSIZE)
+	}
+
+	tap := isTAP(iface)
+
+	go func() {
+		for {
+			packet := <-free
+			plen, err := readIface(iface, packet, tap)
+			if err != nil {
+				close(packets)
+				return
+			}
+			packets <- packet[:plen]
+			if stop.Load() {
+				close(packets)
+				return
+			}
+		}
+	}()
+
+	pc := ipv4.NewPacketConn(conn)
+	encrypted := make([][]byte, batch)
+	for i := range encrypted {
+		encrypted[i] = make([]byte, BUFFERSIZE)
+	}
+	pending := make([]IPPacket, 0, batch)
+	var msgs []ipv4.Message
+
+	for packet := range packets {
+		pending = append(pending[:0], packet)
+
+	collect:
+		for len(pending) < batch {
+			select {
+			case p, ok := <-packets:
+				if !ok {
+					break collect
+				}
+				pending = append(pending, p)
+			default:
+				break collect
+			}
+		}
+
+		// each batch get pointer to (probably) new config
+		c := config.Load().(VPNState)
+
+		msgs = msgs[:0]
+		for i, p := range pending {
+			tsize, dsts := prepareOutgoing(&c, p, encrypted[i], ivbuf)
+			free <- p
+
+			for _, addr := range dsts {
+				if !c.directUDP(addr) {
+					if _, err := c.sendTo(conn, encrypted[i][:tsize], addr); nil != err {
+						log.Println("Error sending package:", err)
+					}
+					continue
+				}
+				msgs = append(msgs, ipv4.Message{
+					Buffers: [][]byte{encrypted[i][:tsize]},
+					Addr:    addr,
+				})
+			}
+		}
+
+		groupByDst(msgs)
+
+		for sent := 0; sent < len(msgs); {
+			n, err := pc.WriteBatch(msgs[sent:], 0)
+			if nil != err {
+				log.Println("Error sending package:", err)
+				break
+			}
+			sent += n
+		}
+	}
+}
+
+// groupByDst orders messages by destination keeping order of packets
+// for same remote
+func groupByDst(msgs []ipv4.Message) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		a := msgs[i].Addr.(*net.UDPAddr)
+		b := msgs[j].Addr.(*net.UDPAddr)
+		if c := bytes.Compare(a.IP, b.IP); 0 != c {
+			return c < 0
+		}
+		return a.Port < b.Port
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+const benchBatch = 32
+
+// chanIface reads packets from in (EOF when it's closed) and writes to out
+type chanIface struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (i *chanIface) Read(b []byte) (int, error) {
+	p, ok := <-i.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, p), nil
+}
+
+func (i *chanIface) Write(b []byte) (int, error) {
+	i.out <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (i *chanIface) Close() error { return nil }
+func (i *chanIface) Name() string { return "chan0" }
+
+func TestGroupByDst(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 23456}
+	a2 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 23457}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 23456}
+
+	var msgs []ipv4.Message
+	for i, addr := range []*net.UDPAddr{b, a, a2, b, a, b} {
+		msgs = append(msgs, ipv4.Message{Buffers: [][]byte{{byte(i)}}, Addr: addr})
+	}
+	groupByDst(msgs)
+
+	want := []struct {
+		addr *net.UDPAddr
+		id   byte
+	}{{a, 1}, {a, 4}, {a2, 2}, {b, 0}, {b, 3}, {b, 5}}
+	for i, w := range want {
+		if msgs[i].Addr != w.addr || msgs[i].Buffers[0][0] != w.id {
+			t.Errorf("message %d: got %s/%d, want %s/%d", i,
+				msgs[i].Addr, msgs[i].Buffers[0][0], w.addr, w.id)
+		}
+	}
+}
+
+func TestBatchLoops(t *testing.T) {
+	rcv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Skip("unable to listen on loopback:", err)
+	}
+	snd, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer snd.Close()
+
+	e, err := newAesCbc("4A34E352D7C32FC42F1CEB0CAA54D40E")
+	if nil != err {
+		t.Fatal(err)
+	}
+	var c VPNState
+	c.Main.main = e
+	c.remotes = map[[4]byte]*net.UDPAddr{{192, 168, 3, 3}: rcv.LocalAddr().(*net.UDPAddr)}
+	config.Store(c)
+	defer config.Store(VPNState{})
+
+	in := &chanIface{in: make(chan []byte), out: make(chan []byte, 64)}
+	out := &chanIface{in: make(chan []byte), out: make(chan []byte, 64)}
+	var stop atomic.Bool
+	go rcvrBatchLoop(rcv, out, 8)
+	go sndrBatchLoop(snd, in, 8, &stop)
+	defer close(in.in)
+	defer rcv.Close()
+
+	// packets differ by IP id and are delivered in order
+	const count = 20
+	for i := 0; i < count; i++ {
+		p := append(IPPacket{}, testICMPPing...)
+		p[5] = byte(i)
+		in.in <- p
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case p := <-out.out:
+			want := append(IPPacket{}, testICMPPing...)
+			want[5] = byte(i)
+			if !bytes.Equal(p, want) {
+				t.Fatalf("packet %d differs: got id %d", i, p[5])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d packets delivered", i, count)
+		}
+	}
+}
+
+// benchUDPPair returns sender and address of receiver which drains socket
+func benchUDPPair(b *testing.B) (*net.UDPConn, *net.UDPAddr) {
+	rcv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		b.Skip("unable to listen on loopback:", err)
+	}
+	b.Cleanup(func() { rcv.Close() })
+
+	go func() {
+		buf := make([]byte, BUFFERSIZE)
+		for {
+			if _, _, err := rcv.ReadFrom(buf); nil != err {
+				return
+			}
+		}
+	}()
+
+	snd, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { snd.Close() })
+
+	return snd, rcv.LocalAddr().(*net.UDPAddr)
+}
+
+func benchEncrypter(b *testing.B) PacketEncrypter {
+	e, err := newAesCbc("4A34E352D7C32FC42F1CEB0CAA54D40E")
+	if nil != err {
+		b.Fatal(err)
+	}
+	return e
+}
+
+func reportPPS(b *testing.B, start time.Time) {
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pps")
+}
+
+func BenchmarkSendSingle(b *testing.B) {
+	conn, addr := benchUDPPair(b)
+	e := benchEncrypter(b)
+	iv := make([]byte, e.IVLen())
+	packet := make([]byte, BUFFERSIZE)
+	encrypted := make([]byte, BUFFERSIZE)
+	plen := e.AdjustInputSize(MTU)
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		tsize := e.Encrypt(packet[:plen], encrypted, iv)
+		if _, err := conn.WriteToUDP(encrypted[:tsize], addr); nil != err {
+			b.Fatal(err)
+		}
+	}
+	reportPPS(b, start)
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+	conn, addr := benchUDPPair(b)
+	pc := ipv4.NewPacketConn(conn)
+	e := benchEncrypter(b)
+	iv := make([]byte, e.IVLen())
+	packet := make([]byte, BUFFERSIZE)
+	plen := e.AdjustInputSize(MTU)
+
+	msgs := make([]ipv4.Message, benchBatch)
+	encrypted := make([][]byte, benchBatch)
+	for i := range msgs {
+		encrypted[i] = make([]byte, BUFFERSIZE)
+		msgs[i].Addr = addr
+		msgs[i].Buffers = [][]byte{nil}
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i += benchBatch {
+		n := benchBatch
+		if b.N-i < n {
+			n = b.N - i
+		}
+		for j := 0; j < n; j++ {
+			tsize := e.Encrypt(packet[:plen], encrypted[j], iv)
+			msgs[j].Buffers[0] = encrypted[j][:tsize]
+		}
+		for sent := 0; sent < n; {
+			k, err := pc.WriteBatch(msgs[sent:n], 0)
+			if nil != err {
+				b.Fatal(err)
+			}
+			sent += k
+		}
+	}
+	reportPPS(b, start)
+}
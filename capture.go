@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Capture writes packets as seen by sender and receiver threads to pcapng
+// file, it's started and stopped by USR2 signal. Plaintext packets are
+// recorded on interface 0 (raw IPv4 or ethernet in tap mode), encrypted
+// datagrams (with captureEncrypted) on interface 1 with synthesized
+// IPv4/UDP header. Each record has comment with remote name, direction
+// and drop reason.
+
+const (
+	pcapngSHB = 0x0A0D0D0A
+	pcapngIDB = 1
+	pcapngEPB = 6
+
+	pcapngByteOrder = 0x1A2B3C4D
+
+	pcapngOptEnd     = 0
+	pcapngOptComment = 1
+	pcapngOptIfName  = 2
+
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+
+	captureSnapLen = 0xffff
+
+	captureIfPlain     = 0
+	captureIfEncrypted = 1
+
+	captureIn  = "in"
+	captureOut = "out"
+)
+
+// captureWriter is one running capture
+type captureWriter struct {
+	sync.Mutex
+	file      string
+	f         *os.File
+	w         *bufio.Writer
+	peers     map[string]bool
+	encrypted bool
+	maxSize   uint64
+	size      uint64
+	deadline  time.Time
+	closed    bool
+}
+
+var capture atomic.Pointer[captureWriter]
+
+// capturing returns running capture if packets of peer are captured
+func capturing(peer string) *captureWriter {
+	cw := capture.Load()
+	if nil == cw || (0 != len(cw.peers) && !cw.peers[peer]) {
+		return nil
+	}
+	return cw
+}
+
+// captureIncoming records received plaintext packet or ethernet message
+func (c *VPNState) captureIncoming(from net.Addr, packet []byte, reason string) {
+	if nil == capture.Load() {
+		return
+	}
+	peer := c.peerName(from)
+	cw := capturing(peer)
+	if nil == cw {
+		return
+	}
+	if msgEthernet == msgType(packet) {
+		packet = packet[msgHeaderLen:]
+	}
+	cw.record(captureIfPlain, packet, captureComment(peer, captureIn, reason))
+}
+
+// captureDatagram records encrypted datagram exchanged with remote addr
+func (c *VPNState) captureDatagram(dir string, addr net.Addr, data []byte, reason string) {
+	if nil == capture.Load() {
+		return
+	}
+	peer := c.peerName(addr)
+	cw := capturing(peer)
+	if nil == cw || !cw.encrypted {
+		return
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || nil == udpAddr.IP.To4() {
+		return
+	}
+
+	// 20 bytes IPv4 header + 8 bytes UDP header, local side is 0.0.0.0
+	pkt := make([]byte, 28+len(data))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 17
+	port := uint16(udpAddr.Port)
+	if captureIn == dir {
+		copy(pkt[12:16], udpAddr.IP.To4())
+		binary.BigEndian.PutUint16(pkt[20:], port)
+	} else {
+		copy(pkt[16:20], udpAddr.IP.To4())
+		binary.BigEndian.PutUint16(pkt[22:], port)
+	}
+	binary.BigEndian.PutUint16(pkt[24:], uint16(8+len(data)))
+	ipv4HeaderChecksum(pkt, 20)
+	copy(pkt[28:], data)
+
+	cw.record(captureIfEncrypted, pkt, captureComment(peer, dir, reason))
+}
+
+func captureComment(peer, dir, reason string) string {
+	comment := fmt.Sprintf("peer=%s dir=%s", peer, dir)
+	if "" != reason {
+		comment += " drop=" + reason
+	}
+	return comment
+}
+
+// peerNames returns names of remotes for capture annotation
+func (c *VPNState) peerNames(dsts []*net.UDPAddr) string {
+	names := make([]string, 0, len(dsts))
+	for _, addr := range dsts {
+		if p, ok := c.peers[addr]; ok {
+			names = append(names, p.name)
+		} else {
+			names = append(names, addr.String())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// peerName returns name of remote which sent datagram
+func (c *VPNState) peerName(from net.Addr) string {
+	if p := c.peerFrom(from); nil != p {
+		return p.name
+	}
+	return from.String()
+}
+
+// captureOutgoing records packet read from local interface, with peer
+// filter it's captured if any of destinations matches
+func (c *VPNState) captureOutgoing(dsts []*net.UDPAddr, packet []byte, reason string) {
+	cw := capture.Load()
+	if nil == cw {
+		return
+	}
+	if 0 != len(cw.peers) {
+		match := false
+		for _, addr := range dsts {
+			if p, ok := c.peers[addr]; ok && cw.peers[p.name] {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return
+		}
+	}
+	if msgEthernet == msgType(packet) {
+		packet = packet[msgHeaderLen:]
+	}
+	cw.record(captureIfPlain, packet, captureComment(c.peerNames(dsts), captureOut, reason))
+}
+
+// pcapngBlock appends block with body (padded to 4 bytes) and options
+func pcapngBlock(buf []byte, btype uint32, body []byte, options []byte) []byte {
+	pad := (4 - len(body)%4) % 4
+	total := 12 + len(body) + pad + len(options)
+	buf = binary.LittleEndian.AppendUint32(buf, btype)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(total))
+	buf = append(buf, body...)
+	buf = append(buf, make([]byte, pad)...)
+	buf = append(buf, options...)
+	return binary.LittleEndian.AppendUint32(buf, uint32(total))
+}
+
+// pcapngOption appends option (value padded to 4 bytes)
+func pcapngOption(buf []byte, code uint16, value []byte) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, code)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	return append(buf, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// pcapngHeader returns section header and interface description blocks
+func pcapngHeader(tap bool) []byte {
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrder)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // version 1.0
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff) // unknown section length
+	buf := pcapngBlock(nil, pcapngSHB, shb, nil)
+
+	link := uint16(linkTypeRaw)
+	if tap {
+		link = linkTypeEthernet
+	}
+	for _, iface := range []struct {
+		link uint16
+		name string
+	}{{link, "plaintext"}, {linkTypeRaw, "encrypted"}} {
+		idb := binary.LittleEndian.AppendUint16(nil, iface.link)
+		idb = binary.LittleEndian.AppendUint16(idb, 0)
+		idb = binary.LittleEndian.AppendUint32(idb, captureSnapLen)
+		opts := pcapngOption(nil, pcapngOptIfName, []byte(iface.name))
+		opts = pcapngOption(opts, pcapngOptEnd, nil)
+		buf = pcapngBlock(buf, pcapngIDB, idb, opts)
+	}
+	return buf
+}
+
+// pcapngPacket returns enhanced packet block with comment, packet longer
+// than snaplen is truncated (original length is kept)
+func pcapngPacket(iface uint32, ts time.Time, packet []byte, comment string) []byte {
+	captured := packet
+	if len(captured) > captureSnapLen {
+		captured = captured[:captureSnapLen]
+	}
+	us := uint64(ts.UnixNano() / 1000)
+	epb := binary.LittleEndian.AppendUint32(nil, iface)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(captured)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = append(epb, captured...)
+	opts := pcapngOption(nil, pcapngOptComment, []byte(comment))
+	opts = pcapngOption(opts, pcapngOptEnd, nil)
+	return pcapngBlock(nil, pcapngEPB, epb, opts)
+}
+
+// record writes packet to capture file, capture is stopped when size
+// or time limit is reached
+func (cw *captureWriter) record(iface uint32, packet []byte, comment string) {
+	now := time.Now()
+	block := pcapngPacket(iface, now, packet, comment)
+
+	cw.Lock()
+	defer cw.Unlock()
+	if cw.closed {
+		return
+	}
+	if (0 != cw.maxSize && cw.size+uint64(len(block)) > cw.maxSize) ||
+		(!cw.deadline.IsZero() && now.After(cw.deadline)) {
+		cw.closeLocked("limit reached")
+		return
+	}
+	if _, err := cw.w.Write(block); nil != err {
+		cw.closeLocked(err.Error())
+		return
+	}
+	cw.size += uint64(len(block))
+}
+
+func (cw *captureWriter) closeLocked(reason string) {
+	if cw.closed {
+		return
+	}
+	cw.closed = true
+	capture.CompareAndSwap(cw, nil)
+
+	err := cw.w.Flush()
+	if cerr := cw.f.Close(); nil == err {
+		err = cerr
+	}
+	if nil != err {
+		log.Println("Error writing capture file:", err)
+	}
+	log.Printf("Capture %s stopped (%s), %d bytes written\n", cw.file, reason, cw.size)
+}
+
+// captureFileName returns name of new capture file with timestamp
+func captureFileName(template string, now time.Time) string {
+	if "" == template {
+		template = filepath.Join(os.TempDir(), "lcvpn.pcapng")
+	}
+	ext := filepath.Ext(template)
+	return strings.TrimSuffix(template, ext) + now.Format("-20060102-150405") + ext
+}
+
+// startCapture creates capture file using settings from config
+func startCapture(c *VPNState) (*captureWriter, error) {
+	cw := &captureWriter{
+		file:      captureFileName(c.Main.CaptureFile, time.Now()),
+		peers:     map[string]bool{},
+		encrypted: c.Main.CaptureEncrypted,
+		maxSize:   c.Main.captureMaxSize,
+	}
+	for _, p := range c.Main.CapturePeer {
+		cw.peers[p] = true
+	}
+	if 0 != c.Main.captureMaxTime {
+		cw.deadline = time.Now().Add(c.Main.captureMaxTime)
+	}
+
+	f, err := os.OpenFile(cw.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if nil != err {
+		return nil, err
+	}
+	cw.f = f
+	cw.w = bufio.NewWriter(f)
+	header := pcapngHeader(c.Main.tap)
+	if _, err := cw.w.Write(header); nil != err {
+		f.Close()
+		return nil, err
+	}
+	cw.size = uint64(len(header))
+	return cw, nil
+}
+
+// toggleCapture starts capture or stops running one
+func toggleCapture() {
+	if cw := capture.Load(); nil != cw {
+		cw.Lock()
+		cw.closeLocked("by signal")
+		cw.Unlock()
+		return
+	}
+
+	c := config.Load().(VPNState)
+	cw, err := startCapture(&c)
+	if nil != err {
+		log.Println("Unable to start capture:", err)
+		return
+	}
+	capture.Store(cw)
+	log.Println("Capture started:", cw.file)
+
+	if !cw.deadline.IsZero() {
+		// stop capture in time even without packets
+		time.AfterFunc(time.Until(cw.deadline), func() {
+			cw.Lock()
+			cw.closeLocked("limit reached")
+			cw.Unlock()
+		})
+	}
+}
+
+// captureThread toggles capture on USR2 signal
+func captureThread() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+
+	for range c {
+		toggleCapture()
+	}
+}
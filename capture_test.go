@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pcapngBlocks returns types and bodies of blocks in pcapng file
+func pcapngBlocks(t *testing.T, data []byte) ([]uint32, [][]byte) {
+	t.Helper()
+	var types []uint32
+	var bodies [][]byte
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %d bytes", len(data))
+		}
+		btype := binary.LittleEndian.Uint32(data)
+		total := int(binary.LittleEndian.Uint32(data[4:]))
+		if 0 != total%4 || total > len(data) || total != int(binary.LittleEndian.Uint32(data[total-4:])) {
+			t.Fatalf("invalid block length %d", total)
+		}
+		types = append(types, btype)
+		bodies = append(bodies, data[8:total-4])
+		data = data[total:]
+	}
+	return types, bodies
+}
+
+func TestCapture(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 23456}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 23456}
+	var c VPNState
+	c.Main.CaptureFile = filepath.Join(t.TempDir(), "test.pcapng")
+	c.Main.CapturePeer = []string{"office"}
+	c.Main.CaptureEncrypted = true
+	c.peers = map[*net.UDPAddr]*peerInfo{
+		addr:  {name: "office"},
+		other: {name: "other"},
+	}
+
+	cw, err := startCapture(&c)
+	if nil != err {
+		t.Fatal(err)
+	}
+	capture.Store(cw)
+
+	c.captureOutgoing([]*net.UDPAddr{addr}, testICMPPing, "")
+	c.captureOutgoing([]*net.UDPAddr{other}, testICMPPing, "")
+	c.captureIncoming(addr, testICMPPing, "IPv4 in tap mode")
+	c.captureDatagram(captureOut, addr, []byte{1, 2, 3, 4, 5}, "")
+
+	cw.Lock()
+	cw.closeLocked("test")
+	cw.Unlock()
+	if nil != capture.Load() {
+		t.Fatal("capture is still running")
+	}
+
+	data, err := os.ReadFile(cw.file)
+	if nil != err {
+		t.Fatal(err)
+	}
+	types, bodies := pcapngBlocks(t, data)
+	want := []uint32{pcapngSHB, pcapngIDB, pcapngIDB, pcapngEPB, pcapngEPB, pcapngEPB}
+	if len(types) != len(want) {
+		t.Fatalf("blocks %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("blocks %v, want %v", types, want)
+		}
+	}
+
+	comments := []string{"peer=office dir=out", "peer=office dir=in drop=IPv4 in tap mode", "peer=office dir=out"}
+	for i, body := range bodies[3:] {
+		iface := binary.LittleEndian.Uint32(body)
+		caplen := int(binary.LittleEndian.Uint32(body[12:]))
+		if (2 == i) != (captureIfEncrypted == iface) {
+			t.Errorf("packet %d recorded on interface %d", i, iface)
+		}
+		if 2 == i && 28+5 != caplen {
+			t.Errorf("encrypted datagram length %d", caplen)
+		}
+		if !strings.Contains(string(body[20+caplen:]), comments[i]) {
+			t.Errorf("packet %d has no comment %q", i, comments[i])
+		}
+	}
+}
+
+func TestCaptureMaxSize(t *testing.T) {
+	var c VPNState
+	c.Main.CaptureFile = filepath.Join(t.TempDir(), "test.pcapng")
+	c.Main.captureMaxSize = 512
+
+	cw, err := startCapture(&c)
+	if nil != err {
+		t.Fatal(err)
+	}
+	capture.Store(cw)
+	for i := 0; i < 10; i++ {
+		c.captureOutgoing(nil, testICMPPing, "no remote")
+	}
+	if nil != capture.Load() {
+		t.Fatal("capture is not stopped by size limit")
+	}
+	if st, err := os.Stat(cw.file); nil != err || st.Size() > 512 {
+		t.Fatalf("capture file is too big: %v %v", st.Size(), err)
+	}
+}
+
+func TestPcapngPacketSnapLen(t *testing.T) {
+	packet := make([]byte, captureSnapLen+100)
+	block := pcapngPacket(captureIfEncrypted, time.Now(), packet, "")
+	caplen := binary.LittleEndian.Uint32(block[8+12:])
+	origlen := binary.LittleEndian.Uint32(block[8+16:])
+	if captureSnapLen != caplen || uint32(len(packet)) != origlen {
+		t.Errorf("caplen %d, original length %d", caplen, origlen)
+	}
+	if total := binary.LittleEndian.Uint32(block[4:]); int(total) != len(block) || len(block) >= len(packet) {
+		t.Errorf("block length %d", total)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// compressStats contains counters of compression
+var compressStats struct {
+	in         uint64 // bytes before compression
+	out        uint64 // bytes after compression (or raw if incompressible)
+	compressed uint64 // packets sent compressed
+	raw        uint64 // packets sent raw as incompressible
+}
+
+var (
+	compressors = sync.Pool{
+		New: func() interface{} { return &lz4.Compressor{} },
+	}
+	compressBufs = sync.Pool{
+		New: func() interface{} { return make([]byte, BUFFERSIZE) },
+	}
+)
+
+// compressFor returns true if all dsts accept compressed messages
+func (c *VPNState) compressFor(dsts []*net.UDPAddr) bool {
+	for _, addr := range dsts {
+		if p, ok := c.peers[addr]; !ok || !p.compress {
+			return false
+		}
+	}
+	return 0 != len(dsts)
+}
+
+// compressMsg replaces first plen bytes of packet by msgCompressed message
+// if it's smaller, returns new length (plen if packet is left raw)
+func compressMsg(packet []byte, plen int) int {
+	buf := compressBufs.Get().([]byte)
+	defer compressBufs.Put(buf)
+
+	comp := compressors.Get().(*lz4.Compressor)
+	n, err := comp.CompressBlock(packet[:plen], buf[msgHeaderLen:plen])
+	compressors.Put(comp)
+
+	atomic.AddUint64(&compressStats.in, uint64(plen))
+
+	if nil != err || 0 == n || n+msgHeaderLen >= plen {
+		// incompressible, send as is
+		atomic.AddUint64(&compressStats.out, uint64(plen))
+		atomic.AddUint64(&compressStats.raw, 1)
+		return plen
+	}
+
+	size := n + msgHeaderLen
+	putMsgHeader(buf, msgCompressed, size)
+	copy(packet, buf[:size])
+
+	atomic.AddUint64(&compressStats.out, uint64(size))
+	atomic.AddUint64(&compressStats.compressed, 1)
+	return size
+}
+
+// decompressMsg replaces msgCompressed message in msg by original one,
+// returns it's size and false on error
+func decompressMsg(msg []byte, size int) (int, bool) {
+	buf := compressBufs.Get().([]byte)
+	defer compressBufs.Put(buf)
+
+	n, err := lz4.UncompressBlock(msg[msgHeaderLen:size], buf[:MTU+msgHeaderLen+ethHeaderLen])
+	if nil != err {
+		log.Println("Unable to decompress message:", err)
+		return 0, false
+	}
+
+	if n < msgHeaderLen || msgCompressed == msgType(buf) || !knownMsgType(msgType(buf)) ||
+		(*IPPacket)(&buf).GetSize() > n {
+		log.Println("Invalid decompressed message")
+		return 0, false
+	}
+
+	copy(msg, buf[:n])
+	return (*IPPacket)(&buf).GetSize(), true
+}
+
+func compressionStats() string {
+	in := atomic.LoadUint64(&compressStats.in)
+	out := atomic.LoadUint64(&compressStats.out)
+	ratio := 1.0
+	if 0 != in {
+		ratio = float64(out) / float64(in)
+	}
+	return fmt.Sprintf("%d packets compressed, %d sent raw, %d -> %d bytes (ratio %.3f)",
+		atomic.LoadUint64(&compressStats.compressed),
+		atomic.LoadUint64(&compressStats.raw), in, out, ratio)
+}
+
+func init() {
+	registeredStats["compression"] = compressionStats
+}
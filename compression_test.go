@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressMsg(t *testing.T) {
+	tests := []struct {
+		name       string
+		p          []byte
+		compressed bool
+	}{
+		{
+			name:       "ping",
+			p:          testICMPPing,
+			compressed: false,
+		},
+		{
+			name:       "text",
+			p:          append(append([]byte{}, testICMPPing[:20]...), bytes.Repeat([]byte(`{"log":"message"}`), 60)...),
+			compressed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := append([]byte{}, tt.p...)
+			p[2], p[3] = byte(len(p)>>8), byte(len(p))
+			original := append([]byte{}, p...)
+
+			buf := make([]byte, BUFFERSIZE)
+			copy(buf, p)
+			n := compressMsg(buf, len(p))
+
+			if got := msgCompressed == msgType(buf); got != tt.compressed {
+				t.Fatalf("compressed = %v, want %v", got, tt.compressed)
+			}
+			if !tt.compressed {
+				if n != len(p) || !bytes.Equal(buf[:n], original) {
+					t.Error("raw packet modified")
+				}
+				return
+			}
+			if n >= len(p) {
+				t.Errorf("compressed size %d not smaller than %d", n, len(p))
+			}
+
+			size, ok := decompressMsg(buf, n)
+			if !ok {
+				t.Fatal("decompressMsg() failed")
+			}
+			if !bytes.Equal(buf[:size], original) {
+				t.Error("decompressed message differs")
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/cipher"
+	"crypto/ed25519"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,11 +10,14 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
-	"gopkg.in/gcfg.v1"
+	"github.com/kanocz/lcvpn/netlink"
 )
 
 // VPNState represents config mixed with pre-parsed values
@@ -26,21 +31,137 @@ type VPNState struct {
 		NetCIDR     int
 		RecvThreads int
 		SendThreads int
+		MSSClamp    bool
+		BatchSize   int
+		MultiQueue  bool
+		Offload     bool
+		Pipeline    bool
+		Mode        string
+		Bridge      string
+
+		MulticastSnooping bool
+		NoBroadcast       bool
+		Compress          bool
+		FEC               string
+
+		Include     []string
+		PeersDir    string
+		WatchConfig bool
+
+		ConfigURL      string
+		ConfigKey      string
+		ConfigCache    string
+		ConfigInterval string
+
+		Gossip      bool
+		GossipKey   string
+		GossipTrust []string
+
+		ExportRoutes []string
+
+		Transport     string
+		TCPPort       int
+		TLSPort       int
+		TLSCert       string
+		TLSKey        string
+		TLSCA         string
+		TLSServerName string
+
+		Padding      string
+		Obfuscate    bool
+		ObfuscateKey string
+
+		Multipath string
+
+		QoS       bool
+		RateLimit string
+
+		AccountingFile string
+		Quota          string
+		QuotaAction    string
+		QuotaHook      string
+
+		CaptureFile      string
+		CapturePeer      []string
+		CaptureEncrypted bool
+		CaptureMaxSize   string
+		CaptureMaxTime   string
 
 		// filled by readConfig
 		bcastIP [4]byte
 		main    PacketEncrypter
 		alt     PacketEncrypter
 		local   string
+		tap     bool
+		obfs    cipher.Block
+		qos     bool
+
+		captureMaxSize uint64
+		captureMaxTime time.Duration
+
+		configKey      ed25519.PublicKey
+		configInterval time.Duration
+		sourceDoc      *configDoc
+
+		localName   string
+		localRemote *remoteConfig
+		locIP       [4]byte
+		binds       []string
+		gossipKey   ed25519.PrivateKey
+		gossipTrust []ed25519.PublicKey
+
+		exportRoutes []routeSelector
 	}
-	Remote map[string]*struct {
-		ExtIP string
-		LocIP string
-		Route []string
-	}
+	Remote map[string]*remoteConfig
 	// filled by readConfig
-	remotes map[[4]byte]*net.UDPAddr
-	routes  map[*net.IPNet]*net.UDPAddr
+	remotes    map[[4]byte]*net.UDPAddr
+	remoteList []*net.UDPAddr
+	bcastList  []*net.UDPAddr
+	extRemotes map[[4]byte]*net.UDPAddr
+	peers      map[*net.UDPAddr]*peerInfo
+	routes     map[*net.IPNet]*net.UDPAddr
+	routeOpts  map[*net.IPNet]routeOptions
+	routeAcct  map[*net.IPNet]*acctCounters
+	watched    []string
+}
+
+// remoteConfig is [remote "name"] section of config
+type remoteConfig struct {
+	ExtIP string
+	LocIP string
+	Route []string
+
+	NoBroadcast bool
+	Compress    bool
+	FEC         string
+	Transport   string
+	Padding     string
+	Obfuscate   bool
+	Path        []string
+	Bind        []string
+	Multipath   string
+	RateLimit   string
+	Quota       string
+	QuotaAction string
+}
+
+// peerInfo contains per remote settings
+type peerInfo struct {
+	name      string
+	compress  bool
+	fec       fecParams
+	transport Transport
+	padding   paddingPolicy
+	obfuscate bool
+	paths     []pathInfo
+	multipath string
+	rr        uint32
+	rateLimit int64 // bytes per second
+
+	acct        *acctCounters
+	routes      []acctRoute
+	quota       uint64
+	quotaAction string
 }
 
 var (
@@ -67,95 +188,312 @@ func getLocalIPsMap() map[string]bool {
 	return result
 }
 
+// readConfig loads config file and makes it current, on error current
+// config is not changed
 func readConfig() error {
+	newConfig, problems := loadConfig(*configfile)
+	if 0 != len(problems) {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	config.Store(*newConfig)
+
+	return nil
+}
+
+// loadConfig reads config file and fills derived fields,
+// returns list of all problems found
+func loadConfig(file string) (*VPNState, []string) {
 	var newConfig VPNState
 
-	err := gcfg.ReadFileInto(&newConfig, *configfile)
+	err := loadConfigFile(file, &newConfig)
 	if nil != err {
-		return fmt.Errorf("Error reading config \"%s\" %s", *configfile, err)
+		return nil, []string{fmt.Sprintf("Error reading config \"%s\" %s", file, err)}
+	}
+
+	problems := includeConfigs(file, &newConfig)
+	problems = append(problems, checkConfig(&newConfig)...)
+
+	localName := *local
+	if "" == localName {
+		if localName = detectLocal(&newConfig); "" == localName {
+			return nil, append(problems, "Local ip can't be detected")
+		}
 	}
-	if newConfig.Main.Port < 1 || newConfig.Main.Port > 65535 {
-		return errors.New("main.port is invalid in config")
+	problems = append(problems, newConfig.prepare(file, localName, true)...)
+	if 0 != len(problems) {
+		return nil, problems
 	}
-	if newConfig.Main.NetCIDR < 8 || newConfig.Main.NetCIDR > 30 {
-		return errors.New("netCIDR can't be less than 8 or greater than 30")
+	newConfig.registerAcct()
+	newConfig.watched = configWatched(file, &newConfig)
+	return &newConfig, nil
+}
+
+// validateConfig checks config file without side effects and any I/O
+// besides reading files: local host is given by localName (without it
+// remotes are checked as seen by other hosts) and extip names aren't
+// resolved
+func validateConfig(file, localName string) []string {
+	var newConfig VPNState
+
+	err := loadConfigFile(file, &newConfig)
+	if nil != err {
+		return []string{fmt.Sprintf("Error reading config \"%s\" %s", file, err)}
+	}
+
+	problems := includeConfigs(file, &newConfig)
+	problems = append(problems, checkConfig(&newConfig)...)
+	return append(problems, newConfig.prepare(file, localName, false)...)
+}
+
+// detectLocal returns name of remote with extip of this host
+func detectLocal(c *VPNState) string {
+	ips := getLocalIPsMap()
+	for name, r := range c.Remote {
+		if _, ok := ips[r.ExtIP]; ok {
+			log.Printf("%s/%d (%s) is detected as local ip\n", r.LocIP, c.Main.NetCIDR, name)
+			return name
+		}
+	}
+	return ""
+}
+
+// registerAcct attaches accounting counters to remotes and routes
+func (c *VPNState) registerAcct() {
+	for _, peer := range c.peers {
+		peer.acct = peerAcct(peer.name)
+		for i := range peer.routes {
+			peer.routes[i].acct = routeAcct(peer.routes[i].net)
+			c.routeAcct[peer.routes[i].net] = peer.routes[i].acct
+		}
+	}
+}
+
+// prepare validates settings and fills derived fields of just read config
+// for local host localName (problems of addresses and routes are reported
+// by checkConfig), names in extip are resolved only with resolve, source
+// is name of config file used in messages
+func (newConfig *VPNState) prepare(source, localName string, resolve bool) []string {
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	var err error
+
+	switch strings.ToLower(newConfig.Main.Mode) {
+	case "", "tun":
+	case "tap":
+		newConfig.Main.tap = true
+		if newConfig.Main.Offload {
+			problem("main.offload is supported only in tun mode")
+		}
+	default:
+		problem("main.mode \"%s\" is unknown", newConfig.Main.Mode)
 	}
 
 	if "" == newConfig.Main.Encryption {
-		return errors.New("main.encryption is empty")
+		problem("main.encryption is empty")
+	} else if newEFunc, ok := registeredEncrypters[strings.ToLower(newConfig.Main.Encryption)]; !ok {
+		problem("main.encryption type \"%s\" is unknown", newConfig.Main.Encryption)
+	} else {
+		newConfig.Main.main, err = newEFunc(newConfig.Main.MainKey)
+		if nil != err {
+			problem("main.mainkey error: %s", err.Error())
+		}
+
+		if "" != newConfig.Main.AltKey {
+			newConfig.Main.alt, err = newEFunc(newConfig.Main.AltKey)
+			if nil != err {
+				problem("main.altkey error: %s", err.Error())
+			}
+		}
 	}
-	newEFunc, ok := registeredEncrypters[strings.ToLower(newConfig.Main.Encryption)]
-	if !ok {
-		return fmt.Errorf(
-			"main.encryption type \"%s\" is unknown",
-			newConfig.Main.Encryption)
+
+	if !validTransport(strings.ToLower(newConfig.Main.Transport)) {
+		problem("main.transport \"%s\" is unknown", newConfig.Main.Transport)
 	}
 
-	newConfig.Main.main, err = newEFunc(newConfig.Main.MainKey)
-	if nil != err {
-		return fmt.Errorf("main.mainkey error: %s", err.Error())
+	newConfig.Main.qos = newConfig.Main.QoS
+
+	if newConfig.Main.captureMaxSize, err = parseSize(newConfig.Main.CaptureMaxSize); nil != err {
+		problem("main.captureMaxSize is invalid: %s", err)
+	}
+	if "" != newConfig.Main.CaptureMaxTime {
+		if newConfig.Main.captureMaxTime, err = time.ParseDuration(newConfig.Main.CaptureMaxTime); nil != err {
+			problem("main.captureMaxTime is invalid: %s", err)
+		}
 	}
 
-	if "" != newConfig.Main.AltKey {
-		newConfig.Main.alt, err = newEFunc(newConfig.Main.AltKey)
+	if "" != newConfig.Main.ConfigInterval {
+		if newConfig.Main.configInterval, err = time.ParseDuration(newConfig.Main.ConfigInterval); nil != err {
+			problem("main.configInterval is invalid: %s", err)
+		} else if newConfig.Main.configInterval < minConfigInterval {
+			problem("main.configInterval %s is shorter than %s", newConfig.Main.configInterval, minConfigInterval)
+		}
+	}
+
+	if newConfig.Main.Gossip {
+		if newConfig.Main.gossipKey, newConfig.Main.gossipTrust, err = parseGossipKeys(
+			newConfig.Main.GossipKey, newConfig.Main.GossipTrust); nil != err {
+			problem("%s", err)
+		}
+	}
+
+	for _, e := range newConfig.Main.ExportRoutes {
+		sel, err := parseRouteSelector(e)
 		if nil != err {
-			return fmt.Errorf("main.altkey error: %s", err.Error())
+			problem("main.exportRoutes \"%s\": %s", e, err)
+			continue
 		}
+		newConfig.Main.exportRoutes = append(newConfig.Main.exportRoutes, sel)
 	}
 
-	// local ip detect or select
-	if "" != *local {
-		host, ok := newConfig.Remote[*local]
+	// transport of local host section is used for all remotes
+	var localTransport string
+
+	// local host section (detected or given by -local)
+	if "" != localName {
+		host, ok := newConfig.Remote[localName]
 		if !ok {
-			return fmt.Errorf(
+			return append(problems, fmt.Sprintf(
 				"Remote with id \"%s\" not found in %s",
-				*local, *configfile)
+				localName, source))
 		}
 		newConfig.Main.local = fmt.Sprintf("%s/%d",
 			host.LocIP, newConfig.Main.NetCIDR)
+		newConfig.Main.localName, newConfig.Main.localRemote = localName, host
+		localTransport = host.Transport
 
-		// we don't need it in routes and so on
-		delete(newConfig.Remote, *local)
-	} else {
-		ips := getLocalIPsMap()
-		for name, r := range newConfig.Remote {
-			if _, ok := ips[r.ExtIP]; ok {
-				newConfig.Main.local = fmt.Sprintf("%s/%d", r.LocIP, newConfig.Main.NetCIDR)
-				log.Printf("%s (%s) is detected as local ip\n", newConfig.Main.local, name)
-				// we don't need it in routes and so on
-				delete(newConfig.Remote, name)
-				break
-			}
+		if ip := net.ParseIP(host.LocIP).To4(); nil != ip {
+			copy(newConfig.Main.locIP[:], ip)
 		}
-		if "" == newConfig.Main.local {
-			return errors.New("Local ip can't be detected")
+		// bind addresses are local, so they are taken from local host section
+		for _, b := range host.Bind {
+			if nil == net.ParseIP(b).To4() {
+				problem("Invalid bind address %s", b)
+				continue
+			}
+			newConfig.Main.binds = append(newConfig.Main.binds, b)
 		}
+
+		// we don't need it in routes and so on
+		delete(newConfig.Remote, localName)
 	}
 
 	newConfig.remotes = make(map[[4]byte]*net.UDPAddr, len(newConfig.Remote))
 	newConfig.routes = map[*net.IPNet]*net.UDPAddr{}
+	newConfig.routeOpts = map[*net.IPNet]routeOptions{}
+	newConfig.routeAcct = map[*net.IPNet]*acctCounters{}
+	newConfig.extRemotes = make(map[[4]byte]*net.UDPAddr, len(newConfig.Remote))
+	newConfig.peers = make(map[*net.UDPAddr]*peerInfo, len(newConfig.Remote))
 
 	for name, r := range newConfig.Remote {
 
-		rmtAddr, err := net.ResolveUDPAddr("udp",
-			fmt.Sprintf("%s:%d", r.ExtIP, newConfig.Main.Port))
-		if nil != err {
-			return err
+		// without resolve only names are left unresolved (and unchecked)
+		rmtAddr := &net.UDPAddr{IP: net.ParseIP(r.ExtIP), Port: newConfig.Main.Port}
+		if resolve || nil != rmtAddr.IP {
+			if rmtAddr, err = net.ResolveUDPAddr("udp",
+				fmt.Sprintf("%s:%d", r.ExtIP, newConfig.Main.Port)); nil != err {
+				problem("Invalid extip for %s: %s", name, err)
+				continue
+			}
 		}
 
-		tIP := net.ParseIP(r.LocIP)
+		tIP := net.ParseIP(r.LocIP).To4()
 		if nil == tIP {
-			log.Fatalln("Invalid local ip", r.LocIP, "for server", name)
+			continue
 		}
 
-		newConfig.remotes[[4]byte{tIP[12], tIP[13], tIP[14], tIP[15]}] = rmtAddr
+		newConfig.remotes[[4]byte{tIP[0], tIP[1], tIP[2], tIP[3]}] = rmtAddr
+		newConfig.remoteList = append(newConfig.remoteList, rmtAddr)
+		peer := &peerInfo{
+			name:      name,
+			compress:  newConfig.Main.Compress || r.Compress,
+			obfuscate: newConfig.Main.Obfuscate || r.Obfuscate,
+		}
+		fec := newConfig.Main.FEC
+		if "" != r.FEC {
+			fec = r.FEC
+		}
+		if peer.fec, err = parseFEC(fec); nil != err {
+			problem("Invalid fec for %s: %s", name, err)
+		}
+		transport, err := newConfig.peerTransport(localTransport, r.Transport)
+		if nil != err {
+			problem("Invalid transport for %s: %s", name, err)
+		}
+		peer.transport = transportByName(transport)
+		padding := newConfig.Main.Padding
+		if "" != r.Padding {
+			padding = r.Padding
+		}
+		if peer.padding, err = parsePadding(padding); nil != err {
+			problem("Invalid padding for %s: %s", name, err)
+		}
+		if peer.obfuscate && nil == newConfig.Main.obfs {
+			if newConfig.Main.obfs, err = newObfuscator(newConfig.Main.ObfuscateKey); nil != err {
+				problem("%s", err)
+				peer.obfuscate = false
+			}
+		}
+		if 0 != len(r.Path) || 0 != len(newConfig.Main.binds) {
+			if peer.paths, err = parsePaths(rmtAddr, r.Path, newConfig.Main.binds); nil != err {
+				problem("Invalid path for %s: %s", name, err)
+			}
+			for _, path := range peer.paths {
+				if key, ok := extKey(path.addr); ok {
+					newConfig.extRemotes[key] = rmtAddr
+				}
+			}
+		}
+		peer.multipath = strings.ToLower(newConfig.Main.Multipath)
+		if "" != r.Multipath {
+			peer.multipath = strings.ToLower(r.Multipath)
+		}
+		if !validMultipath(peer.multipath) {
+			problem("Invalid multipath mode \"%s\" for %s", peer.multipath, name)
+		}
+		rate := newConfig.Main.RateLimit
+		if "" != r.RateLimit {
+			rate = r.RateLimit
+		}
+		if peer.rateLimit, err = parseRate(rate); nil != err {
+			problem("Invalid rateLimit for %s: %s", name, err)
+		}
+		if peer.rateLimit > 0 {
+			newConfig.Main.qos = true
+		}
+		quota := newConfig.Main.Quota
+		if "" != r.Quota {
+			quota = r.Quota
+		}
+		if peer.quota, err = parseSize(quota); nil != err {
+			problem("Invalid quota for %s: %s", name, err)
+		}
+		peer.quotaAction = strings.ToLower(newConfig.Main.QuotaAction)
+		if "" != r.QuotaAction {
+			peer.quotaAction = strings.ToLower(r.QuotaAction)
+		}
+		if !validQuotaAction(peer.quotaAction) {
+			problem("Invalid quotaAction \"%s\" for %s", peer.quotaAction, name)
+		}
+		newConfig.peers[rmtAddr] = peer
+		if !newConfig.Main.NoBroadcast && !r.NoBroadcast {
+			newConfig.bcastList = append(newConfig.bcastList, rmtAddr)
+		}
+		if ip4 := rmtAddr.IP.To4(); nil != ip4 {
+			newConfig.extRemotes[[4]byte{ip4[0], ip4[1], ip4[2], ip4[3]}] = rmtAddr
+		}
 
 		for _, routestr := range r.Route {
-			_, route, err := net.ParseCIDR(routestr)
+			route, opts, err := parseRoute(routestr)
 			if nil != err {
-				return fmt.Errorf("Invalid route %s for %s", routestr, name)
+				continue
 			}
 			newConfig.routes[route] = rmtAddr
+			newConfig.routeOpts[route] = opts
+			peer.routes = append(peer.routes, acctRoute{net: route})
 		}
 	}
 
@@ -172,9 +510,101 @@ func readConfig() error {
 		newConfig.Main.SendThreads = 1
 	}
 
-	config.Store(newConfig)
+	// only one mode of send/receive threads is used: qos, batch, pipeline
+	if newConfig.Main.BatchSize > 1 && newConfig.Main.Pipeline {
+		problem("main.batchsize and main.pipeline can't be used together")
+	}
+	if newConfig.Main.qos && (newConfig.Main.BatchSize > 1 || newConfig.Main.Pipeline) {
+		log.Println("main.batchsize and main.pipeline are not used by send threads with qos or rateLimit")
+	}
+
+	return problems
+}
 
-	return nil
+// peerTransport selects transport for remote, stream transport requested
+// by any side of link is used, TLS is preferred over TCP
+func (c *VPNState) peerTransport(local, remote string) (string, error) {
+	result := ""
+	for _, t := range []string{c.Main.Transport, local, remote} {
+		t = strings.ToLower(t)
+		if !validTransport(t) {
+			return "", fmt.Errorf("transport \"%s\" is unknown", t)
+		}
+		if transportTLS == t || (transportTCP == t && transportTLS != result) {
+			result = t
+		}
+	}
+
+	switch result {
+	case transportTCP:
+		if c.Main.TCPPort < 1 || c.Main.TCPPort > 65535 {
+			return "", errors.New("main.tcpport is required for tcp transport")
+		}
+	case transportTLS:
+		if c.Main.TLSPort < 1 || c.Main.TLSPort > 65535 {
+			return "", errors.New("main.tlsport is required for tls transport")
+		}
+		if "" == c.Main.TLSCert || "" == c.Main.TLSKey {
+			return "", errors.New("main.tlscert and main.tlskey are required for tls transport")
+		}
+	}
+
+	return result, nil
+}
+
+// routeOptions are kernel attributes of route given after network in
+// remote section, e.g. "10.1.0.0/16 metric=100 table=200 src=192.168.3.1 replace"
+type routeOptions struct {
+	netlink.RouteOptions
+	src string
+}
+
+// parseRoute parses network and options of route
+func parseRoute(s string) (*net.IPNet, routeOptions, error) {
+	var opts routeOptions
+	fields := strings.Fields(s)
+	if 0 == len(fields) {
+		return nil, opts, errors.New("empty route")
+	}
+	_, route, err := net.ParseCIDR(fields[0])
+	if nil != err {
+		return nil, opts, err
+	}
+	if nil == route.IP.To4() {
+		return nil, opts, errors.New("only IPv4 routes are supported")
+	}
+
+	for _, opt := range fields[1:] {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "metric":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if nil != err {
+				return nil, opts, fmt.Errorf("invalid metric \"%s\"", value)
+			}
+			opts.Metric = int(n)
+		case "table":
+			if "main" == value {
+				opts.Table = 0
+				continue
+			}
+			n, err := strconv.ParseUint(value, 10, 32)
+			if nil != err || 0 == n {
+				return nil, opts, fmt.Errorf("invalid table \"%s\"", value)
+			}
+			opts.Table = int(n)
+		case "src":
+			if nil == net.ParseIP(value).To4() {
+				return nil, opts, fmt.Errorf("invalid src \"%s\"", value)
+			}
+			opts.src = value
+		case "replace":
+			opts.Replace = true
+		default:
+			return nil, opts, fmt.Errorf("unknown option \"%s\"", opt)
+		}
+	}
+	return route, opts, nil
 }
 
 func initConfig(routeReload chan bool) {
@@ -189,13 +619,65 @@ func initConfig(routeReload chan bool) {
 	signal.Notify(c, syscall.SIGHUP)
 	go func() {
 		for range c {
-			err := readConfig()
-			if nil != err {
-				log.Println("Config reload failed:", err)
-			} else {
-				log.Println("Config reloaded")
-				routeReload <- true
-			}
+			reloadConfig(routeReload, "signal")
 		}
 	}()
+
+	go configWatchThread(routeReload)
+	go configSourceThread(routeReload)
+	go gossipThread(routeReload)
+	go routeAdvThread(routeReload)
+}
+
+var (
+	// reloadLock serializes reloads by signal and by file watcher
+	reloadLock sync.Mutex
+
+	// configReloaded is notified after each successful reload
+	configReloaded = make(chan struct{}, 1)
+
+	reloadStats struct {
+		ok     uint64
+		failed uint64
+	}
+)
+
+// reloadConfig reloads config, on error previous one is kept
+func reloadConfig(routeReload chan bool, reason string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	return reloadConfigLocked(routeReload, reason)
+}
+
+// reloadConfigLocked is reloadConfig for caller holding reloadLock
+func reloadConfigLocked(routeReload chan bool, reason string) error {
+	if err := readConfig(); nil != err {
+		atomic.AddUint64(&reloadStats.failed, 1)
+		log.Printf("Config reload (%s) failed: %s\n", reason, err)
+		return err
+	}
+	atomic.AddUint64(&reloadStats.ok, 1)
+	log.Printf("Config reloaded (%s)\n", reason)
+
+	c := config.Load().(VPNState)
+	if err := applyTransports(&c); nil != err {
+		log.Println("Unable to apply config:", err)
+	}
+
+	select {
+	case configReloaded <- struct{}{}:
+	default:
+	}
+	routeReload <- true
+	return nil
+}
+
+func reloadStatistics() string {
+	return fmt.Sprintf("%d reloads, %d failed",
+		atomic.LoadUint64(&reloadStats.ok), atomic.LoadUint64(&reloadStats.failed))
+}
+
+func init() {
+	registeredStats["config"] = reloadStatistics
 }
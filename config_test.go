@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kanocz/lcvpn/netlink"
+	"gopkg.in/gcfg.v1"
+)
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		broadcast string
+		remotes   []string
+		problems  []string
+	}{
+		{
+			name:      "valid",
+			broadcast: "192.168.3.255",
+			remotes: []string{
+				"[remote \"a\"]\nextIP = 1.1.1.1\nlocIP = 192.168.3.1\nroute = 10.1.0.0/16\n",
+				"[remote \"b\"]\nextIP = 2.2.2.2\nlocIP = 192.168.3.2\nroute = 10.2.0.0/16\n",
+			},
+		},
+		{
+			name: "duplicates",
+			remotes: []string{
+				"[remote \"a\"]\nextIP = 1.1.1.1\nlocIP = 192.168.3.1\n",
+				"[remote \"b\"]\nextIP = 1.1.1.1\nlocIP = 192.168.3.1\n",
+			},
+			problems: []string{
+				"Local ip 192.168.3.1 of b is already used by a",
+				"External ip 1.1.1.1 of b is already used by a",
+			},
+		},
+		{
+			name: "invalid and outside network",
+			remotes: []string{
+				"[remote \"a\"]\nextIP = 1.1.1.1\nlocIP = 192.168.3.1\n",
+				"[remote \"b\"]\nextIP = 2.2.2.2\nlocIP = 192.168.3.2\n",
+				"[remote \"c\"]\nextIP = 3.3.3.3\nlocIP = 192.168.4.3\n",
+				"[remote \"d\"]\nextIP = 4.4.4.4\nlocIP = bad\n",
+				"[remote \"e\"]\nextIP = 5.5.5.5\nlocIP = 192.168.3.255\n",
+			},
+			problems: []string{
+				"Invalid local ip \"bad\" for d",
+				"Local ip 192.168.4.3 of c is outside of network 192.168.3.0/24",
+				"Local ip 192.168.3.255 of e is network or broadcast address of 192.168.3.0/24",
+			},
+		},
+		{
+			name:      "broadcast mismatch",
+			broadcast: "192.168.4.255",
+			remotes: []string{
+				"[remote \"a\"]\nextIP = 1.1.1.1\nlocIP = 192.168.3.1\n",
+			},
+			problems: []string{
+				"main.broadcast 192.168.4.255 doesn't match network 192.168.3.0/24 (expected 192.168.3.255)",
+			},
+		},
+		{
+			name: "routes",
+			remotes: []string{
+				"[remote \"a\"]\nextIP = 1.1.1.1\nlocIP = 192.168.3.1\nroute = 10.0.0.0/8\nroute = 192.168.0.0/16\n",
+				"[remote \"b\"]\nextIP = 2.2.2.2\nlocIP = 192.168.3.2\nroute = 10.1.0.0/16\nroute = bad\n",
+			},
+			problems: []string{
+				"Route 192.168.0.0/16 of a overlaps network 192.168.3.0/24",
+				"Route 10.1.0.0/16 of b overlaps route 10.0.0.0/8 of a",
+				"Invalid route bad for b",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c VPNState
+			text := fmt.Sprintf("[main]\nport = 23456\nnetCIDR = 24\nbroadcast = %s\n", tt.broadcast)
+			for _, r := range tt.remotes {
+				text += r
+			}
+			if err := gcfg.ReadStringInto(&c, text); nil != err {
+				t.Fatal(err)
+			}
+
+			problems := checkConfig(&c)
+			if !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("got %q, want %q", problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestConfigLoaders(t *testing.T) {
+	files := map[string]string{
+		"lcvpn.conf": `[main]
+port = 23456
+netCIDR = 24
+encryption = aescbc
+
+[remote "prague"]
+extIP = 1.1.1.1
+locIP = 192.168.3.15
+route = 192.168.10.0/24
+route = 192.168.15.0/24
+`,
+		"lcvpn.json": `{
+  "main": {"port": 23456, "netcidr": 24, "encryption": "aescbc"},
+  "remote": {
+    "prague": {"extIP": "1.1.1.1", "locIP": "192.168.3.15",
+      "route": ["192.168.10.0/24", "192.168.15.0/24"]}
+  }
+}`,
+		"lcvpn.yaml": `main:
+  port: 23456
+  netCIDR: 24
+  encryption: aescbc
+remote:
+  prague:
+    extIP: 1.1.1.1
+    locIP: 192.168.3.15
+    route:
+      - 192.168.10.0/24
+      - 192.168.15.0/24
+`,
+	}
+
+	dir := t.TempDir()
+	var want *VPNState
+	for _, name := range []string{"lcvpn.conf", "lcvpn.json", "lcvpn.yaml"} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(files[name]), 0600); nil != err {
+			t.Fatal(err)
+		}
+		var c VPNState
+		if err := loadConfigFile(file, &c); nil != err {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if nil == want {
+			want = &c
+			continue
+		}
+		if !reflect.DeepEqual(c.Main, want.Main) || !reflect.DeepEqual(c.Remote, want.Remote) {
+			t.Errorf("%s: got %+v, want %+v", name, c, *want)
+		}
+	}
+
+	file := filepath.Join(dir, "unknown.json")
+	if err := os.WriteFile(file, []byte(`{"main": {"prot": 1}}`), 0600); nil != err {
+		t.Fatal(err)
+	}
+	var c VPNState
+	if err := loadConfigFile(file, &c); nil == err {
+		t.Error("unknown field accepted")
+	}
+}
+
+func TestIncludeConfigs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); nil != err {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(text), 0600); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	write("lcvpn.conf", `[main]
+port = 23456
+include = inc/*.conf
+peersDir = peers
+
+[remote "a"]
+extIP = 1.1.1.1
+locIP = 192.168.3.1
+`)
+	write("inc/b.conf", "[remote \"b\"]\nextIP = 2.2.2.2\nlocIP = 192.168.3.2\n")
+	write("inc/c.conf", "[remote \"a\"]\nextIP = 3.3.3.3\nlocIP = 192.168.3.3\n")
+	write("peers/d.json", `{"remote": {"d": {"extIP": "4.4.4.4", "locIP": "192.168.3.4"}}}`)
+	write("peers/e.yaml", "main:\n  port: 1\nremote:\n  e:\n    extIP: 5.5.5.5\n    locIP: 192.168.3.5\n")
+	write("peers/README", "not a config")
+
+	file := filepath.Join(dir, "lcvpn.conf")
+	var c VPNState
+	if err := loadConfigFile(file, &c); nil != err {
+		t.Fatal(err)
+	}
+	problems := includeConfigs(file, &c)
+
+	want := []string{
+		fmt.Sprintf("Remote \"a\" in %s is already defined in %s", filepath.Join(dir, "inc/c.conf"), file),
+		fmt.Sprintf("%s: main section is allowed only in %s", filepath.Join(dir, "peers/e.yaml"), file),
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("got problems %q, want %q", problems, want)
+	}
+
+	for name, ext := range map[string]string{"a": "1.1.1.1", "b": "2.2.2.2", "d": "4.4.4.4", "e": "5.5.5.5"} {
+		if r, ok := c.Remote[name]; !ok || ext != r.ExtIP {
+			t.Errorf("remote %s: got %+v", name, r)
+		}
+	}
+	if 4 != len(c.Remote) {
+		t.Errorf("got %d remotes, want 4", len(c.Remote))
+	}
+}
+
+func TestConfigWatched(t *testing.T) {
+	var c VPNState
+	c.Main.Include = []string{"inc/*.conf"}
+	c.Main.PeersDir = "/etc/lcvpn/peers"
+	c.Main.TLSCert = "/etc/ssl/lcvpn.pem"
+	c.watched = configWatched("/etc/lcvpn.conf", &c)
+
+	tests := []struct {
+		path    string
+		watched bool
+	}{
+		{"/etc/lcvpn.conf", true},
+		{"/etc/lcvpn.conf.swp", false},
+		{"/etc/inc/a.conf", true},
+		{"/etc/inc/a.json", false},
+		{"/etc/lcvpn/peers/b.yaml", true},
+		{"/etc/lcvpn/peers/.b.yaml~", false},
+		{"/etc/ssl/lcvpn.pem", true},
+		{"/etc/ssl/other.pem", false},
+	}
+	for _, tt := range tests {
+		if got := c.isWatched(tt.path); got != tt.watched {
+			t.Errorf("%s: got %v, want %v", tt.path, got, tt.watched)
+		}
+	}
+
+	want := []string{"/etc", "/etc/inc", "/etc/lcvpn/peers", "/etc/ssl"}
+	if dirs := c.watchedDirs(); !reflect.DeepEqual(dirs, want) {
+		t.Errorf("got dirs %q, want %q", dirs, want)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		route string
+		net   string
+		opts  routeOptions
+		ok    bool
+	}{
+		{"10.1.0.0/16", "10.1.0.0/16", routeOptions{}, true},
+		{"10.1.2.3/16 metric=100 table=200", "10.1.0.0/16", routeOptions{RouteOptions: netlink.RouteOptions{Metric: 100, Table: 200}}, true},
+		{"10.1.0.0/16 table=main src=192.168.3.1 replace", "10.1.0.0/16",
+			routeOptions{RouteOptions: netlink.RouteOptions{Replace: true}, src: "192.168.3.1"}, true},
+		{"", "", routeOptions{}, false},
+		{"fd00::/64", "", routeOptions{}, false},
+		{"10.1.0.0/16 metric=-1", "", routeOptions{}, false},
+		{"10.1.0.0/16 table=0", "", routeOptions{}, false},
+		{"10.1.0.0/16 src=fd00::1", "", routeOptions{}, false},
+		{"10.1.0.0/16 via=1.2.3.4", "", routeOptions{}, false},
+	}
+	for _, tt := range tests {
+		route, opts, err := parseRoute(tt.route)
+		if (nil == err) != tt.ok {
+			t.Errorf("%q: got error %v", tt.route, err)
+			continue
+		}
+		if tt.ok && (tt.net != route.String() || tt.opts != opts) {
+			t.Errorf("%q: got %s %+v", tt.route, route, opts)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lcvpn.conf")
+	err := os.WriteFile(file, []byte(`[main]
+port = 23456
+netCIDR = 24
+encryption = aescbc
+mainkey = 4A34E352D7C32FC42F1CEB0CAA54D40E
+
+[remote "a"]
+extIP = 192.0.2.1
+locIP = 192.168.3.1
+route = 192.168.10.0/24
+
+[remote "b"]
+extIP = vpn.invalid
+locIP = 192.168.3.2
+bind = bad
+`), 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// without local host and name resolution config is valid
+	if problems := validateConfig(file, ""); 0 != len(problems) {
+		t.Errorf("got problems %q", problems)
+	}
+	want := []string{"Invalid bind address bad"}
+	if problems := validateConfig(file, "b"); !reflect.DeepEqual(problems, want) {
+		t.Errorf("local b: got problems %q, want %q", problems, want)
+	}
+	want = []string{fmt.Sprintf("Remote with id \"c\" not found in %s", file)}
+	if problems := validateConfig(file, "c"); !reflect.DeepEqual(problems, want) {
+		t.Errorf("unknown local: got problems %q, want %q", problems, want)
+	}
+
+	accounting.Lock()
+	_, peer := accounting.Peers["a"]
+	_, route := accounting.Routes["192.168.10.0/24"]
+	accounting.Unlock()
+	if peer || route {
+		t.Error("accounting counters registered by validation")
+	}
+}
+
+func TestThreadModes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lcvpn.conf")
+	err := os.WriteFile(file, []byte(`[main]
+port = 23456
+netCIDR = 24
+encryption = aescbc
+mainkey = 4A34E352D7C32FC42F1CEB0CAA54D40E
+batchsize = 32
+pipeline = true
+
+[remote "a"]
+extIP = 192.0.2.1
+locIP = 192.168.3.1
+`), 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	want := []string{"main.batchsize and main.pipeline can't be used together"}
+	if problems := validateConfig(file, "a"); !reflect.DeepEqual(problems, want) {
+		t.Errorf("got problems %q, want %q", problems, want)
+	}
+}
+
+func TestConfigInterval(t *testing.T) {
+	for interval, ok := range map[string]bool{"1m": true, "1s": true, "0s": false, "-1m": false, "10ms": false} {
+		c := VPNState{}
+		c.Main.Encryption = "none"
+		c.Main.ConfigInterval = interval
+		if problems := c.prepare("test.conf", "", false); ok != (0 == len(problems)) {
+			t.Errorf("%s: got problems %q", interval, problems)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// checkConfig does semantic checks of just read config (with local host
+// section) and returns all problems found: invalid or duplicate addresses,
+// local ips outside of overlay network, wrong broadcast address and
+// routes which overlap each other or overlay network
+func checkConfig(c *VPNState) []string {
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.Main.Port < 1 || c.Main.Port > 65535 {
+		problem("main.port is invalid in config")
+	}
+	cidrValid := c.Main.NetCIDR >= 8 && c.Main.NetCIDR <= 30
+	if !cidrValid {
+		problem("netCIDR can't be less than 8 or greater than 30")
+	}
+	mask := net.CIDRMask(c.Main.NetCIDR, 32)
+
+	// sorted names for stable report
+	names := make([]string, 0, len(c.Remote))
+	for name := range c.Remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	locIPs := map[string]string{}
+	extIPs := map[string]string{}
+	locals := map[string]net.IP{}
+	networks := map[string]int{}
+
+	for _, name := range names {
+		r := c.Remote[name]
+
+		ip := net.ParseIP(r.LocIP).To4()
+		if nil == ip {
+			problem("Invalid local ip \"%s\" for %s", r.LocIP, name)
+		} else {
+			if other, ok := locIPs[ip.String()]; ok {
+				problem("Local ip %s of %s is already used by %s", ip, name, other)
+			} else {
+				locIPs[ip.String()] = name
+			}
+			locals[name] = ip
+			if cidrValid {
+				networks[ip.Mask(mask).String()]++
+			}
+		}
+
+		if "" == r.ExtIP {
+			problem("Empty extip for %s", name)
+		} else if other, ok := extIPs[r.ExtIP]; ok {
+			problem("External ip %s of %s is already used by %s", r.ExtIP, name, other)
+		} else {
+			extIPs[r.ExtIP] = name
+		}
+	}
+
+	// overlay network is the one most of remotes are in
+	var overlay *net.IPNet
+	if cidrValid {
+		best := ""
+		for n, count := range networks {
+			if "" == best || count > networks[best] || (count == networks[best] && n < best) {
+				best = n
+			}
+		}
+		if "" != best {
+			overlay = &net.IPNet{IP: net.ParseIP(best).To4(), Mask: mask}
+		}
+	}
+
+	if nil != overlay {
+		bcast := make(net.IP, 4)
+		for i := range bcast {
+			bcast[i] = overlay.IP[i] | ^overlay.Mask[i]
+		}
+
+		for _, name := range names {
+			ip, ok := locals[name]
+			if !ok {
+				continue
+			}
+			switch {
+			case !overlay.Contains(ip):
+				problem("Local ip %s of %s is outside of network %s", ip, name, overlay)
+			case ip.Equal(overlay.IP) || ip.Equal(bcast):
+				problem("Local ip %s of %s is network or broadcast address of %s", ip, name, overlay)
+			}
+		}
+
+		if "" != c.Main.Broadcast {
+			if b := net.ParseIP(c.Main.Broadcast).To4(); !bcast.Equal(b) {
+				problem("main.broadcast %s doesn't match network %s (expected %s)",
+					c.Main.Broadcast, overlay, bcast)
+			}
+		}
+	} else if "" != c.Main.Broadcast && nil == net.ParseIP(c.Main.Broadcast).To4() {
+		problem("main.broadcast \"%s\" is invalid", c.Main.Broadcast)
+	}
+
+	type namedRoute struct {
+		name string
+		net  *net.IPNet
+	}
+	var routes []namedRoute
+
+	for _, name := range names {
+		for _, routestr := range c.Remote[name].Route {
+			route, _, err := parseRoute(routestr)
+			if nil != err {
+				problem("Invalid route %s for %s", routestr, name)
+				continue
+			}
+			if nil != overlay && netsOverlap(route, overlay) {
+				problem("Route %s of %s overlaps network %s", route, name, overlay)
+			}
+			for _, other := range routes {
+				if other.name != name && netsOverlap(route, other.net) {
+					problem("Route %s of %s overlaps route %s of %s",
+						route, name, other.net, other.name)
+				}
+			}
+			routes = append(routes, namedRoute{name: name, net: route})
+		}
+	}
+
+	return problems
+}
+
+// netsOverlap returns true if one of networks contains another
+func netsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// knownRoutes returns routes of all remotes and overlay network (network
+// of first valid LocIP) for adding of dynamic routes
+func knownRoutes(c *VPNState) ([]*net.IPNet, *net.IPNet) {
+	var routes []*net.IPNet
+	var overlay *net.IPNet
+	mask := net.CIDRMask(c.Main.NetCIDR, 32)
+	for _, r := range c.Remote {
+		if ip := net.ParseIP(r.LocIP).To4(); nil != ip && nil != mask && nil == overlay {
+			overlay = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		}
+		for _, routestr := range r.Route {
+			if route, _, err := parseRoute(routestr); nil == err {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes, overlay
+}
+
+// addRoutes adds dynamic routes (without kernel options) to remote skipping
+// ones which are invalid or overlap overlay network or known routes,
+// returns updated known routes
+func (r *remoteConfig) addRoutes(candidates []string, routes []*net.IPNet, overlay *net.IPNet) []*net.IPNet {
+	for _, routestr := range candidates {
+		route, _, err := parseRoute(routestr)
+		if nil != err || (nil != overlay && netsOverlap(route, overlay)) {
+			continue
+		}
+		overlaps := false
+		for _, other := range routes {
+			if netsOverlap(route, other) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			r.Route = append(r.Route, route.String())
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/gcfg.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// configLoader decodes config document into VPNState, all loaders fill the
+// same exported fields (names are case insensitive) and config is validated
+// after loading in the same way
+type configLoader func(data []byte, c *VPNState) error
+
+// registeredLoaders contains loaders by file extension, gcfg is used for
+// all other files
+var registeredLoaders = make(map[string]configLoader)
+
+// loaderFor returns loader for config file (or URL path)
+func loaderFor(file string) configLoader {
+	if l, ok := registeredLoaders[strings.ToLower(filepath.Ext(file))]; ok {
+		return l
+	}
+	return loadGcfg
+}
+
+// loadConfigFile reads config file in format given by its extension
+func loadConfigFile(file string, c *VPNState) error {
+	data, err := os.ReadFile(file)
+	if nil != err {
+		return err
+	}
+	return loaderFor(file)(data, c)
+}
+
+func loadGcfg(data []byte, c *VPNState) error {
+	return gcfg.ReadStringInto(c, string(data))
+}
+
+// loadJSON decodes data to c, unknown fields are errors as in gcfg
+func loadJSON(data []byte, c *VPNState) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// loadYAML converts YAML document to JSON, so field names are matched
+// the same way as in JSON config
+func loadYAML(data []byte, c *VPNState) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); nil != err {
+		return err
+	}
+	data, err := json.Marshal(yamlToJSON(doc))
+	if nil != err {
+		return err
+	}
+	return loadJSON(data, c)
+}
+
+// yamlToJSON converts maps with non-string keys (like remote named 1)
+// which can't be encoded to JSON
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = yamlToJSON(e)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = yamlToJSON(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = yamlToJSON(e)
+		}
+	}
+	return v
+}
+
+// configPath returns path p relative to directory of config file
+func configPath(file, p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(filepath.Dir(file), p)
+}
+
+// isConfigFile returns true if file has extension of known config format
+func isConfigFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	_, ok := registeredLoaders[ext]
+	return ok || ".conf" == ext
+}
+
+// includedFiles returns files matched by main.include patterns and config
+// files of main.peersDir, each group is sorted by name, relative paths are
+// relative to directory of main config file
+func includedFiles(file string, c *VPNState) ([]string, []string) {
+	var files, problems []string
+
+	for _, pattern := range c.Main.Include {
+		matches, err := filepath.Glob(configPath(file, pattern))
+		if nil != err {
+			problems = append(problems, fmt.Sprintf("Invalid include \"%s\": %s", pattern, err))
+			continue
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	if "" != c.Main.PeersDir {
+		dir := configPath(file, c.Main.PeersDir)
+		entries, err := os.ReadDir(dir)
+		if nil != err {
+			problems = append(problems, fmt.Sprintf("Invalid peersDir: %s", err))
+		}
+		// entries are sorted by name
+		for _, e := range entries {
+			if !e.IsDir() && isConfigFile(e.Name()) {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	return files, problems
+}
+
+// includeConfigs merges remotes from included files, from config source and
+// learned by gossip to c and adds routes advertised by remotes, included
+// documents can contain only remote sections and each remote can be
+// defined once
+func includeConfigs(file string, c *VPNState) []string {
+	files, problems := includedFiles(file, c)
+	if nil == c.Remote {
+		c.Remote = map[string]*remoteConfig{}
+	}
+	defined := make(map[string]string, len(c.Remote))
+	for name := range c.Remote {
+		defined[name] = file
+	}
+
+	loaded := map[string]bool{}
+	for _, f := range files {
+		if loaded[f] || f == filepath.Clean(file) {
+			continue
+		}
+		loaded[f] = true
+
+		var inc VPNState
+		if err := loadConfigFile(f, &inc); nil != err {
+			problems = append(problems, fmt.Sprintf("Error reading included config \"%s\" %s", f, err))
+			continue
+		}
+		problems = append(problems, mergeRemotes(c, &inc, f, file, defined)...)
+	}
+
+	problems = append(problems, sourceRemotes(file, c, defined)...)
+	gossipRemotes(c, defined)
+	advertisedRemoteRoutes(c)
+
+	return problems
+}
+
+// mergeRemotes adds remotes of included document src to c, defined contains
+// sources of already known remotes
+func mergeRemotes(c *VPNState, inc *VPNState, src, file string, defined map[string]string) []string {
+	var problems []string
+
+	if !reflect.ValueOf(inc.Main).IsZero() {
+		problems = append(problems, fmt.Sprintf("%s: main section is allowed only in %s", src, file))
+	}
+
+	names := make([]string, 0, len(inc.Remote))
+	for name := range inc.Remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if prev, ok := defined[name]; ok {
+			problems = append(problems, fmt.Sprintf(
+				"Remote \"%s\" in %s is already defined in %s", name, src, prev))
+			continue
+		}
+		defined[name] = src
+		c.Remote[name] = inc.Remote[name]
+	}
+
+	return problems
+}
+
+func init() {
+	registeredLoaders[".json"] = loadJSON
+	registeredLoaders[".yaml"] = loadYAML
+	registeredLoaders[".yml"] = loadYAML
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Remotes can be fetched from HTTP(S) config source (main.configURL).
+// Document contains only remote sections (in format given by extension of
+// URL path) and must be signed by Ed25519 key pinned in main.configKey,
+// signature is sent base64 encoded in X-Signature header. Document is
+// applied by normal config reload (and verified by key of config being
+// loaded) and the last good one is kept in main.configCache for next start.
+// Invalid cached document (e.g. after change of configKey) is ignored until
+// new one is fetched.
+
+const (
+	configSignatureHeader = "X-Signature"
+
+	// configSourceInterval is default period of config source polling
+	configSourceInterval = time.Minute
+	// minConfigInterval is shortest period of polling allowed in config
+	minConfigInterval = time.Second
+
+	configSourceTimeout = 30 * time.Second
+
+	maxConfigDocSize = 16 << 20
+)
+
+// configDoc is signed document from config source with cache validators
+type configDoc struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Signature    []byte `json:"signature"`
+	Document     []byte `json:"document"`
+}
+
+// sourceDoc is the last applied document from config source
+var sourceDoc atomic.Pointer[configDoc]
+
+// pendingDoc is just fetched document being applied, guarded by reloadLock
+var pendingDoc *configDoc
+
+var sourceStats struct {
+	fetched     uint64
+	notModified uint64
+	failed      uint64
+}
+
+// parseKey decodes hex or base64 encoded key of given size
+func parseKey(s string, size int) ([]byte, bool) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if nil != err {
+		key, _ = base64.StdEncoding.DecodeString(s)
+	}
+	return key, size == len(key)
+}
+
+// parseConfigKey parses hex or base64 encoded Ed25519 public key
+func parseConfigKey(s string) (ed25519.PublicKey, error) {
+	key, ok := parseKey(s, ed25519.PublicKeySize)
+	if !ok {
+		return nil, errors.New("main.configKey must be hex or base64 encoded Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verify checks signature of document
+func (d *configDoc) verify(key ed25519.PublicKey) error {
+	if !ed25519.Verify(key, d.Document, d.Signature) {
+		return errors.New("invalid signature of config source document")
+	}
+	return nil
+}
+
+// load verifies signature of document and parses it to inc
+func (d *configDoc) load(key ed25519.PublicKey, path string, inc *VPNState) error {
+	if err := d.verify(key); nil != err {
+		return err
+	}
+	if err := loaderFor(path)(d.Document, inc); nil != err {
+		return fmt.Errorf("Error reading config source document %s", err)
+	}
+	return nil
+}
+
+// currentConfigDoc returns document of config source: the last applied
+// one or cached on disk (nil if there is no document yet)
+func currentConfigDoc(c *VPNState) (*configDoc, error) {
+	if d := sourceDoc.Load(); nil != d && d.URL == c.Main.ConfigURL {
+		return d, nil
+	}
+	if "" == c.Main.ConfigCache {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(c.Main.ConfigCache)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var d configDoc
+	if err := json.Unmarshal(data, &d); nil != err {
+		return nil, fmt.Errorf("config cache %s: %s", c.Main.ConfigCache, err)
+	}
+	if d.URL != c.Main.ConfigURL {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+// sourceRemotes merges remotes from config source document to c
+func sourceRemotes(file string, c *VPNState, defined map[string]string) []string {
+	if "" == c.Main.ConfigURL {
+		return nil
+	}
+
+	u, err := url.Parse(c.Main.ConfigURL)
+	if nil != err {
+		return []string{fmt.Sprintf("main.configURL is invalid: %s", err)}
+	}
+	if c.Main.configKey, err = parseConfigKey(c.Main.ConfigKey); nil != err {
+		return []string{err.Error()}
+	}
+
+	// just fetched document must be valid, invalid applied or cached one
+	// is ignored so config can be reloaded with new key
+	d, err := pendingDoc, error(nil)
+	pending := nil != d && d.URL == c.Main.ConfigURL
+	if !pending {
+		d, err = currentConfigDoc(c)
+	}
+
+	var inc VPNState
+	if nil == err && nil != d {
+		err = d.load(c.Main.configKey, u.Path, &inc)
+	}
+	if nil != err {
+		if pending {
+			return []string{err.Error()}
+		}
+		log.Println("Ignoring config source cache:", err)
+		return nil
+	}
+	if nil == d {
+		// nothing fetched yet
+		return nil
+	}
+	c.Main.sourceDoc = d
+	return mergeRemotes(c, &inc, c.Main.ConfigURL, file, defined)
+}
+
+// fetchConfigDoc requests document from config source, returns nil if it's
+// not modified since prev (signature is verified when document is applied)
+func fetchConfigDoc(client *http.Client, u string, prev *configDoc) (*configDoc, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if nil != err {
+		return nil, err
+	}
+	if nil != prev && prev.URL == u {
+		if "" != prev.ETag {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if "" != prev.LastModified {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigDocSize+1))
+	if nil != err {
+		return nil, err
+	}
+	if len(body) > maxConfigDocSize {
+		return nil, errors.New("config source document is too big")
+	}
+	sig, err := base64.StdEncoding.DecodeString(resp.Header.Get(configSignatureHeader))
+	if nil != err {
+		return nil, fmt.Errorf("invalid %s header: %s", configSignatureHeader, err)
+	}
+
+	return &configDoc{
+		URL:          u,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Signature:    sig,
+		Document:     body,
+	}, nil
+}
+
+// updateConfigSource fetches document and applies it by config reload,
+// previous document is kept if new one can't be applied
+func updateConfigSource(client *http.Client, c *VPNState, routeReload chan bool) {
+	// only document used by current config is conditionally requested, so
+	// ignored one (e.g. signed by old key) is fetched again
+	prev := c.Main.sourceDoc
+
+	d, err := fetchConfigDoc(client, c.Main.ConfigURL, prev)
+	if nil != err {
+		atomic.AddUint64(&sourceStats.failed, 1)
+		log.Println("Config source", c.Main.ConfigURL, "failed:", err)
+		return
+	}
+	if nil == d || (nil != prev &&
+		bytes.Equal(prev.Document, d.Document) && bytes.Equal(prev.Signature, d.Signature)) {
+		atomic.AddUint64(&sourceStats.notModified, 1)
+		return
+	}
+
+	reloadLock.Lock()
+	pendingDoc = d
+	err = reloadConfigLocked(routeReload, "config source")
+	pendingDoc = nil
+	if nil == err {
+		sourceDoc.Store(d)
+	}
+	reloadLock.Unlock()
+	if nil != err {
+		atomic.AddUint64(&sourceStats.failed, 1)
+		return
+	}
+	atomic.AddUint64(&sourceStats.fetched, 1)
+
+	if "" != c.Main.ConfigCache {
+		if err := saveJSON(c.Main.ConfigCache, d); nil != err {
+			log.Println("Unable to save config cache:", err)
+		}
+	}
+}
+
+// configSourceThread polls config source
+func configSourceThread(routeReload chan bool) {
+	client := &http.Client{Timeout: configSourceTimeout}
+	for {
+		c := config.Load().(VPNState)
+		interval := configSourceInterval
+		if 0 != c.Main.configInterval {
+			interval = c.Main.configInterval
+		}
+		if "" != c.Main.ConfigURL {
+			updateConfigSource(client, &c, routeReload)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func sourceStatistics() string {
+	return fmt.Sprintf("%d fetched, %d not modified, %d failed",
+		atomic.LoadUint64(&sourceStats.fetched),
+		atomic.LoadUint64(&sourceStats.notModified),
+		atomic.LoadUint64(&sourceStats.failed))
+}
+
+func init() {
+	registeredStats["source"] = sourceStatistics
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigSource(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	doc := []byte(`{"remote": {"b": {"extIP": "2.2.2.2", "locIP": "192.168.3.2"}}}`)
+	sig := ed25519.Sign(priv, doc)
+
+	var notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if `"v1"` == r.Header.Get("If-None-Match") {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if "/bad.json" == r.URL.Path {
+			w.Header().Set(configSignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte("other"))))
+		} else {
+			w.Header().Set(configSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+		}
+		w.Write(doc)
+	}))
+	defer srv.Close()
+
+	u := srv.URL + "/peers.json"
+	d, err := fetchConfigDoc(srv.Client(), u, nil)
+	if nil != err || nil == d || `"v1"` != d.ETag {
+		t.Fatalf("got %+v, %v", d, err)
+	}
+	if again, err := fetchConfigDoc(srv.Client(), u, d); nil != err || nil != again || 1 != notModified {
+		t.Errorf("not modified: got %+v, %v", again, err)
+	}
+	if bad, err := fetchConfigDoc(srv.Client(), srv.URL+"/bad.json", nil); nil != err || nil == bad.verify(pub) {
+		t.Error("invalid signature accepted")
+	}
+
+	// document cached on disk is used and merged with local remotes
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "cache.json")
+	if err := saveJSON(cache, d); nil != err {
+		t.Fatal(err)
+	}
+	var c VPNState
+	c.Main.ConfigURL = u
+	c.Main.ConfigKey = base64.StdEncoding.EncodeToString(pub)
+	c.Main.ConfigCache = cache
+	c.Remote = map[string]*remoteConfig{"a": {ExtIP: "1.1.1.1", LocIP: "192.168.3.1"}}
+	defined := map[string]string{"a": "lcvpn.conf"}
+	if problems := sourceRemotes("lcvpn.conf", &c, defined); 0 != len(problems) {
+		t.Fatal(problems)
+	}
+	if r, ok := c.Remote["b"]; !ok || "2.2.2.2" != r.ExtIP {
+		t.Errorf("remote from config source not merged: %+v", c.Remote)
+	}
+	if nil == c.Main.sourceDoc {
+		t.Error("used document not recorded")
+	}
+
+	// tampered (or signed by old key) cache is ignored
+	tampered := *d
+	tampered.Document = []byte(`{"remote": {"c": {"extIP": "3.3.3.3", "locIP": "192.168.3.3"}}}`)
+	if err := saveJSON(cache, &tampered); nil != err {
+		t.Fatal(err)
+	}
+	c.Remote = map[string]*remoteConfig{}
+	c.Main.sourceDoc = nil
+	if problems := sourceRemotes("lcvpn.conf", &c, map[string]string{}); 0 != len(problems) {
+		t.Errorf("tampered cache: got problems %q", problems)
+	}
+	if _, ok := c.Remote["c"]; ok || nil != c.Main.sourceDoc {
+		t.Error("tampered cache used")
+	}
+
+	// unparsable cache is ignored too
+	if err := os.WriteFile(cache, []byte("garbage"), 0600); nil != err {
+		t.Fatal(err)
+	}
+	if problems := sourceRemotes("lcvpn.conf", &c, map[string]string{}); 0 != len(problems) {
+		t.Errorf("unparsable cache: got problems %q", problems)
+	}
+
+	// but just fetched document must be valid
+	pendingDoc = &tampered
+	defer func() { pendingDoc = nil }()
+	if problems := sourceRemotes("lcvpn.conf", &c, map[string]string{}); 1 != len(problems) {
+		t.Errorf("tampered fetched document: got problems %q", problems)
+	}
+}
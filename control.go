@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Control messages are lcvpn messages of type msgControl exchanged between
+// peers over the encrypted tunnel, second byte of header is subtype
+
+const (
+	// controlInterval is period of sending state announcements
+	controlInterval = 30 * time.Second
+
+	// controlTTL is time after which not refreshed announced state expires
+	controlTTL = 3 * controlInterval
+)
+
+// controlHandler processes received control message, from is external
+// address of remote which sent it
+type controlHandler func(c *VPNState, from [4]byte, payload []byte)
+
+// controlAnnouncer sends periodical state announcements
+type controlAnnouncer func(c *VPNState, s *controlSender)
+
+var (
+	registeredControls   = make(map[byte]controlHandler)
+	registeredAnnouncers = make(map[byte]controlAnnouncer)
+
+	// ctrl is used to send control messages, set in main
+	ctrl *controlSender
+)
+
+// controlSender encrypts and sends control messages
+type controlSender struct {
+	sync.Mutex
+	conn      *net.UDPConn
+	ivbuf     []byte
+	buf       []byte
+	encrypted []byte
+
+	// announce requests immediate announcement of given subtype
+	announce chan byte
+}
+
+func newControlSender(conn *net.UDPConn) *controlSender {
+	s := &controlSender{
+		conn:      conn,
+		ivbuf:     make([]byte, config.Load().(VPNState).Main.main.IVLen()),
+		buf:       make([]byte, BUFFERSIZE),
+		encrypted: make([]byte, BUFFERSIZE),
+		announce:  make(chan byte, 16),
+	}
+	if _, err := io.ReadFull(rand.Reader, s.ivbuf); err != nil {
+		log.Fatalln("Unable to get rand data:", err)
+	}
+	return s
+}
+
+// maxControlPayload returns maximum size of control message payload
+func maxControlPayload() int {
+	return MTU - msgHeaderLen
+}
+
+// Send sends control message with payload to dsts
+func (s *controlSender) Send(c *VPNState, subtype byte, payload []byte, dsts []*net.UDPAddr) {
+	s.send(c, subtype, payload, dsts, nil)
+}
+
+// SendPath sends control message with payload to remote addr by given path
+func (s *controlSender) SendPath(c *VPNState, subtype byte, payload []byte, addr *net.UDPAddr, path pathInfo) {
+	s.send(c, subtype, payload, []*net.UDPAddr{addr}, []pathInfo{path})
+}
+
+func (s *controlSender) send(c *VPNState, subtype byte, payload []byte, dsts []*net.UDPAddr, paths []pathInfo) {
+	if len(payload) > maxControlPayload() {
+		log.Println("Control message too big:", len(payload))
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	size := msgHeaderLen + len(payload)
+	putMsgHeader(s.buf, msgControl, size)
+	s.buf[1] = subtype
+	copy(s.buf[msgHeaderLen:], payload)
+
+	s.sendLocked(c, size, dsts, paths)
+}
+
+// SendMsg sends already prepared message (with header) to dsts
+func (s *controlSender) SendMsg(c *VPNState, msg []byte, dsts []*net.UDPAddr) {
+	if len(msg) > len(s.buf) {
+		log.Println("Message too big:", len(msg))
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	copy(s.buf, msg)
+	s.sendLocked(c, len(msg), dsts, nil)
+}
+
+func (s *controlSender) sendLocked(c *VPNState, size int, dsts []*net.UDPAddr, paths []pathInfo) {
+	tsize := encryptOutgoing(c, s.buf, size, s.encrypted, s.ivbuf)
+	if 0 == tsize {
+		return
+	}
+
+	for _, addr := range dsts {
+		if _, err := c.sendPaths(s.conn, s.encrypted[:tsize], addr, paths); nil != err {
+			log.Println("Error sending control message:", err)
+		}
+	}
+}
+
+// Announce requests immediate announcement of subtype
+func (s *controlSender) Announce(subtype byte) {
+	select {
+	case s.announce <- subtype:
+	default:
+	}
+}
+
+func controlThread(s *controlSender) {
+	ticker := time.NewTicker(controlInterval)
+	for {
+		select {
+		case <-ticker.C:
+			c := config.Load().(VPNState)
+			for _, a := range registeredAnnouncers {
+				a(&c, s)
+			}
+		case subtype := <-s.announce:
+			if a, ok := registeredAnnouncers[subtype]; ok {
+				c := config.Load().(VPNState)
+				a(&c, s)
+			}
+		}
+	}
+}
+
+// extKey returns external IPv4 address of datagram sender
+func extKey(from net.Addr) ([4]byte, bool) {
+	udpAddr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return [4]byte{}, false
+	}
+	ip4 := udpAddr.IP.To4()
+	if nil == ip4 {
+		return [4]byte{}, false
+	}
+	return [4]byte{ip4[0], ip4[1], ip4[2], ip4[3]}, true
+}
+
+// handleControl dispatches received control message to its handler
+func handleControl(c *VPNState, from net.Addr, msg []byte) {
+	key, ok := extKey(from)
+	if !ok {
+		return
+	}
+	// gossip records are signed, so new hosts can announce themselves
+	if _, ok := c.extRemotes[key]; !ok && ctrlGossip != msg[1] {
+		log.Println("Control message from unknown remote", from)
+		return
+	}
+
+	h, ok := registeredControls[msg[1]]
+	if !ok {
+		log.Println("Unknown control message type", msg[1])
+		return
+	}
+	h(c, key, msg[msgHeaderLen:])
+}
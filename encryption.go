@@ -4,7 +4,9 @@ import (
 	"errors"
 )
 
-// PacketEncrypter represents wrapper for encryption alg
+// PacketEncrypter represents wrapper for encryption alg,
+// Encrypt must work in place when output starts IVLen() bytes before input
+// and Decrypt when output starts IVLen() bytes after input
 type PacketEncrypter interface {
 	Encrypt(input []byte, output []byte, iv []byte) int
 	Decrypt(input []byte, output []byte) (int, error)
@@ -26,29 +28,38 @@ var (
 
 	// predefined errors
 	ePacketSmall       = errors.New("Packet too small")
-	ePacketNonIPv4     = errors.New("Non IPv4 packet")
 	ePacketInvalidSize = errors.New("Stored packet size bigger then packet itself")
+	ePacketUnknownType = errors.New("Unknown message type")
 )
 
-func DecryptV4Chk(e PacketEncrypter, src []byte, dst []byte) (int, error) {
+// DecryptMsgChk decrypts IPv4 packet or lcvpn message and checks it's size
+func DecryptMsgChk(e PacketEncrypter, src []byte, dst []byte) (int, error) {
 	num, err := e.Decrypt(src, dst)
 	if nil != err {
 		return 0, err
 	}
 
-	// 2 bytes size + 20 bytes ip header
-	if num < 22 {
+	if num < msgHeaderLen {
 		return 0, ePacketSmall
 	}
 
-	if (*IPPacket)(&dst).IPver() != 4 {
-		return 0, ePacketNonIPv4
+	t := msgType(dst)
+	if !knownMsgType(t) {
+		return 0, ePacketUnknownType
+	}
+
+	// 2 bytes size + 20 bytes ip header
+	if msgIPv4 == t && num < 22 {
+		return 0, ePacketSmall
 	}
 
 	size := (*IPPacket)(&dst).GetSize()
 	if size > num {
 		return 0, ePacketInvalidSize
 	}
+	if msgIPv4 != t && size < msgHeaderLen {
+		return 0, ePacketSmall
+	}
 
 	return size, nil
 }
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Messages to remote with FEC enabled are wrapped into msgFEC messages,
+// after each block of data messages parity messages are sent,
+// so receiver can reconstruct lost ones. FEC header follows message header:
+// [block id (4 bytes), index, data shards, parity shards, reserved],
+// index >= data shards means parity
+
+const (
+	fecHeaderLen = 8
+
+	// fecBlockTimeout is maximum time to wait for block to be filled,
+	// parity for incomplete block is sent after it
+	fecBlockTimeout = 20 * time.Millisecond
+
+	// fecBlockTTL is time to wait for missing shards of block
+	fecBlockTTL = time.Second
+
+	// fecMaxBlocks is maximum number of not completed blocks per remote
+	fecMaxBlocks = 64
+)
+
+var eFECInvalid = errors.New("Invalid FEC message")
+
+// fecParams contains number of data and parity shards in block
+type fecParams struct {
+	data   int
+	parity int
+}
+
+// parseFEC parses "data:parity" (empty string means no FEC)
+func parseFEC(s string) (fecParams, error) {
+	if "" == s {
+		return fecParams{}, nil
+	}
+	parts := strings.Split(s, ":")
+	if 2 != len(parts) {
+		return fecParams{}, errors.New("must be in data:parity format")
+	}
+	data, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if nil != err {
+		return fecParams{}, err
+	}
+	parity, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if nil != err {
+		return fecParams{}, err
+	}
+	if data < 1 || parity < 1 || data+parity > 255 {
+		return fecParams{}, errors.New("data and parity must be positive, up to 255 in sum")
+	}
+	return fecParams{data: data, parity: parity}, nil
+}
+
+var fecStats struct {
+	parity    uint64 // parity messages sent
+	recovered uint64 // messages reconstructed
+	failed    uint64 // blocks expired with missing messages
+}
+
+var rsEncoders = struct {
+	sync.Mutex
+	m map[fecParams]reedsolomon.Encoder
+}{m: map[fecParams]reedsolomon.Encoder{}}
+
+// getRS returns (cached) Reed-Solomon encoder for params
+func getRS(p fecParams) (reedsolomon.Encoder, error) {
+	rsEncoders.Lock()
+	defer rsEncoders.Unlock()
+
+	if rs, ok := rsEncoders.m[p]; ok {
+		return rs, nil
+	}
+	rs, err := reedsolomon.New(p.data, p.parity)
+	if nil != err {
+		return nil, err
+	}
+	rsEncoders.m[p] = rs
+	return rs, nil
+}
+
+func putFECHeader(b []byte, block uint32, index int, p fecParams) {
+	binary.BigEndian.PutUint32(b, block)
+	b[4] = byte(index)
+	b[5] = byte(p.data)
+	b[6] = byte(p.parity)
+	b[7] = 0
+}
+
+// fecEncoder collects data messages sent to one remote
+type fecEncoder struct {
+	sync.Mutex
+	addr    *net.UDPAddr
+	params  fecParams
+	block   uint32
+	shards  [][]byte
+	started time.Time
+}
+
+var fecEncoders = struct {
+	sync.Mutex
+	m map[*net.UDPAddr]*fecEncoder
+}{m: map[*net.UDPAddr]*fecEncoder{}}
+
+func getFECEncoder(addr *net.UDPAddr, p fecParams) *fecEncoder {
+	fecEncoders.Lock()
+	defer fecEncoders.Unlock()
+
+	e, ok := fecEncoders.m[addr]
+	if !ok || e.params != p {
+		e = &fecEncoder{addr: addr, params: p, block: rand.Uint32()}
+		fecEncoders.m[addr] = e
+	}
+	return e
+}
+
+// fecWrap converts first plen bytes of packet into FEC data message for addr,
+// sends parity if block is complete, returns new length of message
+func fecWrap(c *VPNState, addr *net.UDPAddr, p fecParams, packet []byte, plen int) int {
+	size := plen + msgHeaderLen + fecHeaderLen
+	if size > len(packet) {
+		return plen
+	}
+
+	e := getFECEncoder(addr, p)
+	e.Lock()
+
+	if 0 == len(e.shards) {
+		e.started = time.Now()
+	}
+	e.shards = append(e.shards, append([]byte{}, packet[:plen]...))
+
+	copy(packet[msgHeaderLen+fecHeaderLen:], packet[:plen])
+	putMsgHeader(packet, msgFEC, size)
+	putFECHeader(packet[msgHeaderLen:], e.block, len(e.shards)-1, p)
+
+	var parity [][]byte
+	if len(e.shards) >= p.data {
+		parity = e.finish()
+	}
+	e.Unlock()
+
+	sendParity(c, addr, parity)
+
+	return size
+}
+
+// sendParity sends parity messages to remote, with qos they are queued
+// after data of block, so they are rate limited too
+func sendParity(c *VPNState, addr *net.UDPAddr, msgs [][]byte) {
+	if nil == ctrl || 0 == len(msgs) {
+		return
+	}
+	for _, msg := range msgs {
+		if c.Main.qos {
+			queueMsg(ctrl.conn, addr, msg, qosNormal)
+			continue
+		}
+		ctrl.SendMsg(c, msg, []*net.UDPAddr{addr})
+	}
+	atomic.AddUint64(&fecStats.parity, uint64(len(msgs)))
+}
+
+// finish returns parity messages for collected data and starts new block,
+// must be called with encoder locked
+func (e *fecEncoder) finish() [][]byte {
+	p := fecParams{data: len(e.shards), parity: e.params.parity}
+	block := e.block
+	shards := e.shards
+	e.block++
+	e.shards = nil
+
+	rs, err := getRS(p)
+	if nil != err {
+		log.Println("Unable to create FEC encoder:", err)
+		return nil
+	}
+
+	shardLen := 0
+	for _, s := range shards {
+		if len(s) > shardLen {
+			shardLen = len(s)
+		}
+	}
+	for i, s := range shards {
+		shards[i] = append(s, make([]byte, shardLen-len(s))...)
+	}
+
+	hdr := msgHeaderLen + fecHeaderLen
+	msgs := make([][]byte, p.parity)
+	for i := range msgs {
+		msgs[i] = make([]byte, hdr+shardLen)
+		putMsgHeader(msgs[i], msgFEC, hdr+shardLen)
+		putFECHeader(msgs[i][msgHeaderLen:], block, p.data+i, p)
+		shards = append(shards, msgs[i][hdr:])
+	}
+
+	if err := rs.Encode(shards); nil != err {
+		log.Println("FEC encoding failed:", err)
+		return nil
+	}
+
+	return msgs
+}
+
+// fecFlushThread sends parity for blocks which are not filled in time
+func fecFlushThread() {
+	for range time.Tick(fecBlockTimeout) {
+		c := config.Load().(VPNState)
+
+		fecEncoders.Lock()
+		encoders := make([]*fecEncoder, 0, len(fecEncoders.m))
+		for addr, e := range fecEncoders.m {
+			if _, ok := c.peers[addr]; !ok {
+				// remote removed or config reloaded
+				delete(fecEncoders.m, addr)
+				continue
+			}
+			encoders = append(encoders, e)
+		}
+		fecEncoders.Unlock()
+
+		for _, e := range encoders {
+			var parity [][]byte
+			e.Lock()
+			if 0 != len(e.shards) && time.Since(e.started) >= fecBlockTimeout {
+				parity = e.finish()
+			}
+			e.Unlock()
+			sendParity(&c, e.addr, parity)
+		}
+	}
+}
+
+// fecBlock contains received shards of one block
+type fecBlock struct {
+	shards  [][]byte
+	params  fecParams // known after first parity received
+	created time.Time
+	done    bool
+}
+
+// fecDecoder contains not completed blocks received from one remote
+type fecDecoder struct {
+	sync.Mutex
+	blocks map[uint32]*fecBlock
+}
+
+var fecDecoders = struct {
+	sync.Mutex
+	m map[[4]byte]*fecDecoder
+}{m: map[[4]byte]*fecDecoder{}}
+
+type fecRecoveredMsg struct {
+	from net.Addr
+	msg  []byte
+}
+
+// fecRecovered contains reconstructed messages to be written to interface
+var fecRecovered = make(chan fecRecoveredMsg, 256)
+
+func getFECDecoder(key [4]byte) *fecDecoder {
+	fecDecoders.Lock()
+	defer fecDecoders.Unlock()
+
+	d, ok := fecDecoders.m[key]
+	if !ok {
+		d = &fecDecoder{blocks: map[uint32]*fecBlock{}}
+		fecDecoders.m[key] = d
+	}
+	return d
+}
+
+// fecUnwrap stores FEC message and replaces it by wrapped data message,
+// returns its size or 0 for parity message
+func fecUnwrap(from net.Addr, msg []byte, size int) (int, error) {
+	hdr := msgHeaderLen + fecHeaderLen
+	key, ok := extKey(from)
+	if !ok || size <= hdr {
+		return 0, eFECInvalid
+	}
+
+	block := binary.BigEndian.Uint32(msg[msgHeaderLen:])
+	index := int(msg[msgHeaderLen+4])
+	p := fecParams{data: int(msg[msgHeaderLen+5]), parity: int(msg[msgHeaderLen+6])}
+	if 0 == p.data || 0 == p.parity || index >= p.data+p.parity {
+		return 0, eFECInvalid
+	}
+	parity := index >= p.data
+
+	d := getFECDecoder(key)
+	d.Lock()
+	b := d.get(block, p)
+	if parity && 0 == b.params.data {
+		// parity contains real number of data messages in block,
+		// it's smaller than in data messages for not filled block
+		b.params = p
+		if len(b.shards) != p.data+p.parity {
+			shards := make([][]byte, p.data+p.parity)
+			copy(shards[:p.data], b.shards)
+			b.shards = shards
+		}
+	}
+	if index < len(b.shards) && nil == b.shards[index] {
+		b.shards[index] = append([]byte{}, msg[hdr:size]...)
+		d.reconstruct(b, from)
+	}
+	d.Unlock()
+
+	if parity {
+		return 0, nil
+	}
+
+	copy(msg, msg[hdr:size])
+	return size - hdr, nil
+}
+
+// get returns block (creating new one if needed), expires old blocks,
+// must be called with decoder locked
+func (d *fecDecoder) get(block uint32, p fecParams) *fecBlock {
+	if b, ok := d.blocks[block]; ok {
+		return b
+	}
+
+	for id, b := range d.blocks {
+		if len(d.blocks) < fecMaxBlocks && time.Since(b.created) < fecBlockTTL {
+			continue
+		}
+		if !b.done && 0 != b.params.data {
+			atomic.AddUint64(&fecStats.failed, 1)
+		}
+		delete(d.blocks, id)
+	}
+
+	b := &fecBlock{
+		shards:  make([][]byte, p.data+p.parity),
+		created: time.Now(),
+	}
+	d.blocks[block] = b
+	return b
+}
+
+// reconstruct recovers missing data messages if enough shards are received,
+// must be called with decoder locked
+func (d *fecDecoder) reconstruct(b *fecBlock, from net.Addr) {
+	p := b.params
+	if b.done || 0 == p.data || len(b.shards) != p.data+p.parity {
+		return
+	}
+
+	missing := 0
+	present := 0
+	shardLen := 0
+	for i, s := range b.shards {
+		if nil == s {
+			if i < p.data {
+				missing++
+			}
+			continue
+		}
+		present++
+		if i >= p.data {
+			shardLen = len(s)
+		}
+	}
+
+	if 0 == missing {
+		b.done = true
+		return
+	}
+	if present < p.data {
+		return
+	}
+
+	rs, err := getRS(p)
+	if nil != err {
+		log.Println("Unable to create FEC decoder:", err)
+		return
+	}
+
+	shards := make([][]byte, len(b.shards))
+	for i, s := range b.shards {
+		if nil != s {
+			shards[i] = append(s, make([]byte, shardLen-len(s))...)
+		}
+	}
+	if err := rs.ReconstructData(shards); nil != err {
+		log.Println("FEC reconstruction failed:", err)
+		return
+	}
+	b.done = true
+
+	for i := 0; i < p.data; i++ {
+		if nil != b.shards[i] {
+			continue
+		}
+		msg := shards[i]
+		if len(msg) < msgHeaderLen || !knownMsgType(msgType(msg)) ||
+			(*IPPacket)(&msg).GetSize() > len(msg) {
+			continue
+		}
+		select {
+		case fecRecovered <- fecRecoveredMsg{from: from, msg: msg}:
+			atomic.AddUint64(&fecStats.recovered, 1)
+		default:
+			log.Println("FEC recovered queue is full")
+		}
+	}
+}
+
+// fecRecoveredThread writes reconstructed messages to local interface
+func fecRecoveredThread(iface tunIface) {
+	buf := make([]byte, BUFFERSIZE)
+	for r := range fecRecovered {
+		conf := config.Load().(VPNState)
+		copy(buf, r.msg)
+		if data, ok := processMsg(&conf, r.from, buf, (*IPPacket)(&r.msg).GetSize()); ok {
+			writeIface(iface, data)
+			flushIface(iface)
+		}
+	}
+}
+
+func fecStatistics() string {
+	return fmt.Sprintf("%d parity sent, %d recovered, %d blocks not recovered",
+		atomic.LoadUint64(&fecStats.parity),
+		atomic.LoadUint64(&fecStats.recovered),
+		atomic.LoadUint64(&fecStats.failed))
+}
+
+func init() {
+	registeredStats["fec"] = fecStatistics
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseFEC(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    fecParams
+		wantErr bool
+	}{
+		{name: "empty", s: "", want: fecParams{}},
+		{name: "10:3", s: "10:3", want: fecParams{data: 10, parity: 3}},
+		{name: "no parity", s: "10:0", wantErr: true},
+		{name: "too many", s: "200:100", wantErr: true},
+		{name: "invalid", s: "10", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFEC(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFEC() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseFEC() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFECRecovery(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("46.234.105.229"), Port: 23456}
+	from := &net.UDPAddr{IP: addr.IP, Port: 40000}
+	p := fecParams{data: 4, parity: 2}
+
+	pong := append([]byte{}, testICMPPong...)
+	pong = append(pong, 1, 2, 3) // different length
+	pong[2], pong[3] = byte(len(pong)>>8), byte(len(pong))
+	originals := [][]byte{testICMPPing, pong}
+
+	// two messages of 4, so block is finished as not filled one
+	var wrapped [][]byte
+	for _, o := range originals {
+		buf := make([]byte, BUFFERSIZE)
+		copy(buf, o)
+		n := fecWrap(&VPNState{}, addr, p, buf, len(o))
+		if msgFEC != msgType(buf) {
+			t.Fatal("message not wrapped")
+		}
+		wrapped = append(wrapped, buf[:n])
+	}
+	e := getFECEncoder(addr, p)
+	e.Lock()
+	parity := e.finish()
+	e.Unlock()
+	if 2 != len(parity) {
+		t.Fatalf("got %d parity messages, want 2", len(parity))
+	}
+
+	// first message is delivered, second is lost
+	msg := append([]byte{}, wrapped[0]...)
+	size, err := fecUnwrap(from, msg, len(msg))
+	if nil != err || !bytes.Equal(msg[:size], testICMPPing) {
+		t.Fatal("data message not unwrapped")
+	}
+
+	msg = append([]byte{}, parity[1]...)
+	if size, err := fecUnwrap(from, msg, len(msg)); nil != err || 0 != size {
+		t.Error("parity message returned as data")
+	}
+
+	select {
+	case r := <-fecRecovered:
+		if size := (*IPPacket)(&r.msg).GetSize(); !bytes.Equal(r.msg[:size], pong) {
+			t.Error("recovered message differs")
+		}
+	default:
+		t.Fatal("message not recovered")
+	}
+}
@@ -3,15 +3,19 @@ module github.com/kanocz/lcvpn
 go 1.22.2
 
 require (
+	github.com/klauspost/reedsolomon v1.12.4
 	github.com/matishsiao/go_reuseport v0.0.0-20140609025215-7f88524278ad
 	github.com/milosgajdos/tenus v0.0.3
+	github.com/pierrec/lz4/v4 v4.1.22
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	golang.org/x/net v0.35.0
 	gopkg.in/gcfg.v1 v1.2.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/docker/libcontainer v2.2.1+incompatible // indirect
+	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
 )
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With main.gossip hosts announce own remote section (name, extIP, locIP
+// and routes) signed by Ed25519 key to all remotes and relay records
+// learned from others, so new host knowing one peer is learned by whole
+// mesh and learns the rest. Learned remotes are added to config on reload,
+// statically configured ones have precedence. Records not refreshed by
+// their origin expire after controlTTL.
+
+const (
+	// ctrlGossip is control message with signed membership records
+	ctrlGossip = 4
+)
+
+// gossipRecord is membership announcement of one host
+type gossipRecord struct {
+	Name  string   `json:"name"`
+	ExtIP string   `json:"extIP"`
+	LocIP string   `json:"locIP"`
+	Route []string `json:"route,omitempty"`
+	Time  int64    `json:"time"`
+}
+
+// gossipEntry is record with its signed form for relaying
+type gossipEntry struct {
+	rec gossipRecord
+	raw []byte
+	sig []byte
+}
+
+var gossip = struct {
+	sync.Mutex
+	records map[string]*gossipEntry
+	changed chan struct{}
+}{
+	records: map[string]*gossipEntry{},
+	changed: make(chan struct{}, 1),
+}
+
+var gossipStats struct {
+	invalid uint64
+}
+
+// parseGossipKeys parses signing key (seed) and trusted public keys,
+// public key of own key is trusted if no keys are given
+func parseGossipKeys(key string, trust []string) (ed25519.PrivateKey, []ed25519.PublicKey, error) {
+	seed, ok := parseKey(key, ed25519.SeedSize)
+	if !ok {
+		return nil, nil, errors.New("main.gossipKey must be hex or base64 encoded Ed25519 seed (32 bytes)")
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+
+	var pubs []ed25519.PublicKey
+	for _, t := range trust {
+		pub, ok := parseKey(t, ed25519.PublicKeySize)
+		if !ok {
+			return nil, nil, fmt.Errorf("main.gossipTrust \"%s\" is not Ed25519 public key", t)
+		}
+		pubs = append(pubs, ed25519.PublicKey(pub))
+	}
+	if 0 == len(pubs) {
+		pubs = append(pubs, priv.Public().(ed25519.PublicKey))
+	}
+	return priv, pubs, nil
+}
+
+// signGossip returns signed record of local host, only networks of routes
+// are sent (kernel options are local)
+func signGossip(c *VPNState, now time.Time) *gossipEntry {
+	r := c.Main.localRemote
+	rec := gossipRecord{
+		Name:  c.Main.localName,
+		ExtIP: r.ExtIP,
+		LocIP: r.LocIP,
+		Time:  now.Unix(),
+	}
+	for _, routestr := range r.Route {
+		if route, _, err := parseRoute(routestr); nil == err {
+			rec.Route = append(rec.Route, route.String())
+		}
+	}
+	raw, _ := json.Marshal(&rec)
+	return &gossipEntry{rec: rec, raw: raw, sig: ed25519.Sign(c.Main.gossipKey, raw)}
+}
+
+// verifyGossip checks signature by any of trusted keys and decodes record
+func verifyGossip(trust []ed25519.PublicKey, raw, sig []byte) (*gossipEntry, bool) {
+	for _, pub := range trust {
+		if !ed25519.Verify(pub, raw, sig) {
+			continue
+		}
+		e := &gossipEntry{raw: append([]byte{}, raw...), sig: append([]byte{}, sig...)}
+		if err := json.Unmarshal(raw, &e.rec); nil != err || "" == e.rec.Name {
+			return nil, false
+		}
+		return e, true
+	}
+	return nil, false
+}
+
+// gossipFresh returns true if record isn't expired (or from far future)
+func gossipFresh(rec *gossipRecord, now time.Time) bool {
+	age := now.Sub(time.Unix(rec.Time, 0))
+	return age < controlTTL && age > -controlTTL
+}
+
+// packGossip packs entries to payloads of control messages
+func packGossip(entries []*gossipEntry) [][]byte {
+	var payloads [][]byte
+	var payload []byte
+	for _, e := range entries {
+		size := 2 + len(e.raw) + len(e.sig)
+		if size > maxControlPayload() {
+			log.Println("Gossip record of", e.rec.Name, "is too big")
+			continue
+		}
+		if len(payload)+size > maxControlPayload() {
+			payloads = append(payloads, payload)
+			payload = nil
+		}
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(e.raw)))
+		payload = append(payload, e.raw...)
+		payload = append(payload, e.sig...)
+	}
+	if 0 != len(payload) {
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+// announceGossip sends own record and all known ones to all remotes
+func announceGossip(c *VPNState, s *controlSender) {
+	if !c.Main.Gossip || nil == c.Main.gossipKey || nil == c.Main.localRemote {
+		return
+	}
+	now := time.Now()
+
+	entries := []*gossipEntry{signGossip(c, now)}
+	gossip.Lock()
+	names := make([]string, 0, len(gossip.records))
+	for name, e := range gossip.records {
+		if gossipFresh(&e.rec, now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries = append(entries, gossip.records[name])
+	}
+	gossip.Unlock()
+
+	for _, payload := range packGossip(entries) {
+		s.Send(c, ctrlGossip, payload, c.remoteList)
+	}
+}
+
+// handleGossip stores newer records, config is reloaded if membership
+// is changed (it's accepted also from not yet known remotes)
+func handleGossip(c *VPNState, from [4]byte, payload []byte) {
+	if !c.Main.Gossip {
+		return
+	}
+	now := time.Now()
+	changed := false
+
+	gossip.Lock()
+	for len(payload) >= 2 {
+		n := int(binary.BigEndian.Uint16(payload))
+		if len(payload) < 2+n+ed25519.SignatureSize {
+			break
+		}
+		raw := payload[2 : 2+n]
+		sig := payload[2+n : 2+n+ed25519.SignatureSize]
+		payload = payload[2+n+ed25519.SignatureSize:]
+
+		e, ok := verifyGossip(c.Main.gossipTrust, raw, sig)
+		if !ok {
+			atomic.AddUint64(&gossipStats.invalid, 1)
+			log.Println("Invalid gossip record from", net.IP(from[:]))
+			continue
+		}
+		if e.rec.Name == c.Main.localName || !gossipFresh(&e.rec, now) {
+			continue
+		}
+		old, ok := gossip.records[e.rec.Name]
+		if ok && old.rec.Time >= e.rec.Time {
+			continue
+		}
+		if !ok || !sameGossip(&old.rec, &e.rec) {
+			log.Printf("Gossip: remote %s (%s, %s) learned\n", e.rec.Name, e.rec.ExtIP, e.rec.LocIP)
+			changed = true
+		}
+		gossip.records[e.rec.Name] = e
+	}
+	gossip.Unlock()
+
+	if changed {
+		notifyGossip()
+	}
+}
+
+// sameGossip compares records without time
+func sameGossip(a, b *gossipRecord) bool {
+	return a.ExtIP == b.ExtIP && a.LocIP == b.LocIP && reflect.DeepEqual(a.Route, b.Route)
+}
+
+func notifyGossip() {
+	select {
+	case gossip.changed <- struct{}{}:
+	default:
+	}
+}
+
+// expireGossip removes not refreshed records, returns true if any
+func expireGossip(now time.Time) bool {
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	expired := false
+	for name, e := range gossip.records {
+		if !gossipFresh(&e.rec, now) {
+			log.Println("Gossip: remote", name, "expired")
+			delete(gossip.records, name)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// gossipRemotes adds learned remotes to c, remotes which conflict with
+// already defined ones (name, addresses or routes) are skipped
+func gossipRemotes(c *VPNState, defined map[string]string) {
+	if !c.Main.Gossip {
+		return
+	}
+
+	locIPs := map[string]bool{}
+	extIPs := map[string]bool{}
+	for _, r := range c.Remote {
+		locIPs[r.LocIP] = true
+		extIPs[r.ExtIP] = true
+	}
+	routes, overlay := knownRoutes(c)
+
+	now := time.Now()
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	names := make([]string, 0, len(gossip.records))
+	for name := range gossip.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rec := gossip.records[name].rec
+		if _, ok := defined[name]; ok || !gossipFresh(&rec, now) ||
+			locIPs[rec.LocIP] || extIPs[rec.ExtIP] || "" == rec.ExtIP {
+			continue
+		}
+		ip := net.ParseIP(rec.LocIP).To4()
+		if nil == ip || (nil != overlay && !overlay.Contains(ip)) {
+			continue
+		}
+
+		r := &remoteConfig{ExtIP: rec.ExtIP, LocIP: rec.LocIP}
+		routes = r.addRoutes(rec.Route, routes, overlay)
+
+		c.Remote[name] = r
+		defined[name] = "gossip"
+		locIPs[rec.LocIP] = true
+		extIPs[rec.ExtIP] = true
+	}
+}
+
+// gossipThread reloads config when learned membership is changed
+func gossipThread(routeReload chan bool) {
+	ticker := time.NewTicker(controlInterval)
+	for {
+		select {
+		case now := <-ticker.C:
+			if !expireGossip(now) {
+				continue
+			}
+		case <-gossip.changed:
+		}
+
+		if !config.Load().(VPNState).Main.Gossip {
+			continue
+		}
+		if nil == reloadConfig(routeReload, "gossip") && nil != ctrl {
+			// spread changes without waiting for next announcement
+			ctrl.Announce(ctrlGossip)
+		}
+	}
+}
+
+func gossipStatistics() string {
+	gossip.Lock()
+	n := len(gossip.records)
+	gossip.Unlock()
+	return fmt.Sprintf("%d records, %d invalid", n, atomic.LoadUint64(&gossipStats.invalid))
+}
+
+func init() {
+	registeredControls[ctrlGossip] = handleGossip
+	registeredAnnouncers[ctrlGossip] = announceGossip
+	registeredStats["gossip"] = gossipStatistics
+}
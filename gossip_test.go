@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestGossip(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 1
+	priv, trust, err := parseGossipKeys(hex.EncodeToString(seed), nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	gossip.records = map[string]*gossipEntry{}
+	defer func() { gossip.records = map[string]*gossipEntry{} }()
+
+	now := time.Now()
+	sign := func(key ed25519.PrivateKey, name, ext, loc string, routes []string, ts time.Time) *gossipEntry {
+		var c VPNState
+		c.Main.gossipKey = key
+		c.Main.localName = name
+		c.Main.localRemote = &remoteConfig{ExtIP: ext, LocIP: loc, Route: routes}
+		return signGossip(&c, ts)
+	}
+
+	var c VPNState
+	c.Main.Gossip = true
+	c.Main.Port = 23456
+	c.Main.NetCIDR = 24
+	c.Main.gossipKey = priv
+	c.Main.gossipTrust = trust
+	c.Main.localName = "a"
+
+	payloads := packGossip([]*gossipEntry{
+		sign(priv, "a", "1.1.1.1", "192.168.3.1", nil, now),
+		sign(priv, "b", "2.2.2.2", "192.168.3.2", []string{"10.2.0.0/16"}, now),
+		sign(priv, "c", "3.3.3.3", "192.168.3.3", []string{"10.0.0.0/8", "10.3.0.0/16", "192.168.0.0/16"}, now),
+		sign(priv, "d", "4.4.4.4", "192.168.3.4", nil, now.Add(-2*controlTTL)),
+		sign(priv, "e", "5.5.5.5", "192.168.3.5", nil, now),
+		sign(other, "f", "6.6.6.6", "192.168.3.6", nil, now),
+		sign(priv, "g", "2.2.2.2", "192.168.3.7", nil, now),
+		sign(priv, "h", "8.8.8.8", "192.168.4.8", nil, now),
+	})
+	if 1 != len(payloads) {
+		t.Fatalf("got %d payloads", len(payloads))
+	}
+	handleGossip(&c, [4]byte{2, 2, 2, 2}, payloads[0])
+
+	// own, expired and not trusted records are not stored
+	for name, stored := range map[string]bool{"a": false, "b": true, "c": true, "d": false, "e": true, "f": false} {
+		if _, ok := gossip.records[name]; ok != stored {
+			t.Errorf("record %s stored %v, want %v", name, ok, stored)
+		}
+	}
+
+	// kernel options of routes aren't sent
+	e := sign(priv, "b", "2.2.2.2", "192.168.3.2", []string{"10.2.0.0/16 metric=10 src=192.168.3.2", "bad"}, now)
+	if 1 != len(e.rec.Route) || "10.2.0.0/16" != e.rec.Route[0] {
+		t.Errorf("signed routes %q", e.rec.Route)
+	}
+
+	// older record doesn't replace newer one
+	old := packGossip([]*gossipEntry{sign(priv, "b", "9.9.9.9", "192.168.3.9", nil, now.Add(-time.Second))})
+	handleGossip(&c, [4]byte{2, 2, 2, 2}, old[0])
+	if "2.2.2.2" != gossip.records["b"].rec.ExtIP {
+		t.Error("older record replaced newer one")
+	}
+
+	// static remotes have precedence, conflicting records and routes are skipped
+	c.Remote = map[string]*remoteConfig{
+		"a": {ExtIP: "1.1.1.1", LocIP: "192.168.3.1", Route: []string{"10.1.0.0/16"}},
+		"e": {ExtIP: "5.5.5.6", LocIP: "192.168.3.50"},
+	}
+	defined := map[string]string{"a": "lcvpn.conf", "e": "lcvpn.conf"}
+	gossipRemotes(&c, defined)
+
+	if r, ok := c.Remote["b"]; !ok || 1 != len(r.Route) {
+		t.Errorf("remote b: %+v", r)
+	}
+	if r, ok := c.Remote["c"]; !ok || 1 != len(r.Route) || "10.3.0.0/16" != r.Route[0] {
+		t.Errorf("remote c routes: %+v", r)
+	}
+	if "5.5.5.6" != c.Remote["e"].ExtIP {
+		t.Error("static remote e replaced by gossip")
+	}
+	for _, name := range []string{"g", "h"} {
+		if _, ok := c.Remote[name]; ok {
+			t.Errorf("conflicting remote %s added", name)
+		}
+	}
+	if problems := checkConfig(&c); 0 != len(problems) {
+		t.Errorf("config with learned remotes is invalid: %q", problems)
+	}
+
+	if !expireGossip(now.Add(2*controlTTL)) || 0 != len(gossip.records) {
+		t.Error("records not expired")
+	}
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"log"
+	"net"
 	"os/exec"
 	"strconv"
 
@@ -16,7 +17,12 @@ const (
 )
 
 // ifaceSetup returns new interface OR PANIC!
-func ifaceSetup(localCIDR string) *water.Interface {
+// multiqueue and offloads are not supported on darwin and ignored
+func ifaceSetup(localCIDR string, opts ifaceOptions) tunIface {
+
+	if opts.TAP {
+		log.Fatalln("tap mode is not supported on darwin")
+	}
 
 	iface, err := water.New(water.Config{DeviceType: water.TUN})
 
@@ -34,6 +40,21 @@ func ifaceSetup(localCIDR string) *water.Interface {
 	return iface
 }
 
+// ifaceSetAddress replaces address of interface
+func ifaceSetAddress(ifaceName, oldCIDR, newCIDR string) error {
+	if oIP, _, err := net.ParseCIDR(oldCIDR); nil == err {
+		if err := exec.Command("ifconfig", ifaceName, "inet", oIP.String(), "delete").Run(); nil != err {
+			return err
+		}
+	}
+	return exec.Command("ifconfig", ifaceName, "inet", newCIDR).Run()
+}
+
+// ifaceQueueOpener returns nil as multiqueue is not supported on darwin
+func ifaceQueueOpener(iface tunIface, opts ifaceOptions) func() (tunIface, error) {
+	return nil
+}
+
 func routesThread(ifaceName string, refresh chan bool) {
 	currentRoutes := map[string]bool{}
 	for {
@@ -71,3 +92,14 @@ func routesThread(ifaceName string, refresh chan bool) {
 		}
 	}
 }
+
+// cleanupRoutes removes routes of current config
+func cleanupRoutes(ifaceName string) {
+	for r := range config.Load().(VPNState).routes {
+		rs := r.String()
+		log.Println("Removing route:", rs)
+		if err := exec.Command("route", "delete", "-net", rs, "-interface", ifaceName).Run(); err != nil {
+			log.Printf("Error removeing route \"%s\": %s", rs, err.Error())
+		}
+	}
+}
@@ -3,8 +3,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/kanocz/lcvpn/netlink"
 	"github.com/milosgajdos/tenus"
@@ -14,10 +17,16 @@ import (
 const (
 	// MTU used for tunneled packets
 	MTU = 1300
+
+	// rtProtoLcvpn is protocol of kernel routes installed by lcvpn
+	rtProtoLcvpn = 76
+
+	// routeSyncInterval is period of reconciliation of kernel routes
+	routeSyncInterval = 30 * time.Second
 )
 
 // ifaceSetup returns new interface OR PANIC!
-func ifaceSetup(localCIDR string) *water.Interface {
+func ifaceSetup(localCIDR string, opts ifaceOptions) tunIface {
 
 	lIP, lNet, err := net.ParseCIDR(localCIDR)
 	if nil != err {
@@ -25,10 +34,10 @@ func ifaceSetup(localCIDR string) *water.Interface {
 		panic("invalid local ip")
 	}
 
-	iface, err := water.New(water.Config{DeviceType: water.TUN})
+	iface, err := openTun("", opts)
 
 	if nil != err {
-		log.Println("Unable to allocate TUN interface:", err)
+		log.Println("Unable to allocate TUN/TAP interface:", err)
 		panic(err)
 	}
 
@@ -44,9 +53,17 @@ func ifaceSetup(localCIDR string) *water.Interface {
 		log.Fatalln("Unable to set MTU to 1300 on interface")
 	}
 
-	err = link.SetLinkIp(lIP, lNet)
-	if nil != err {
-		log.Fatalln("Unable to set IP to ", lIP, "/", lNet, " on interface")
+	if "" != opts.Bridge {
+		// bridged tap interface doesn't need own ip
+		if err := attachToBridge(iface.Name(), opts.Bridge); nil != err {
+			log.Fatalln("Unable to attach interface to bridge", opts.Bridge, err)
+		}
+		log.Println("Interface attached to bridge", opts.Bridge)
+	} else {
+		err = link.SetLinkIp(lIP, lNet)
+		if nil != err {
+			log.Fatalln("Unable to set IP to ", lIP, "/", lNet, " on interface")
+		}
 	}
 
 	err = link.SetLinkUp()
@@ -57,41 +74,233 @@ func ifaceSetup(localCIDR string) *water.Interface {
 	return iface
 }
 
+// openTun opens new TUN interface or next queue of existing one
+func openTun(name string, opts ifaceOptions) (tunIface, error) {
+	if opts.Offload {
+		return openVnetTun(name, opts.MultiQueue)
+	}
+	devType := water.DeviceType(water.TUN)
+	if opts.TAP {
+		devType = water.TAP
+	}
+	return water.New(water.Config{
+		DeviceType: devType,
+		PlatformSpecificParams: water.PlatformSpecificParams{
+			Name:       name,
+			MultiQueue: opts.MultiQueue,
+		},
+	})
+}
+
+// ifaceSetAddress replaces address of interface, new one is added
+// before old one is removed
+func ifaceSetAddress(ifaceName, oldCIDR, newCIDR string) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if nil != err {
+		return err
+	}
+	nIP, nNet, err := net.ParseCIDR(newCIDR)
+	if nil != err {
+		return err
+	}
+	if err := netlink.NetworkLinkAddIp(iface, nIP, nNet); nil != err {
+		return err
+	}
+	if oIP, oNet, err := net.ParseCIDR(oldCIDR); nil == err {
+		return netlink.NetworkLinkDelIp(iface, oIP, oNet)
+	}
+	return nil
+}
+
+// attachToBridge adds interface to existing linux bridge
+func attachToBridge(ifaceName, bridgeName string) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if nil != err {
+		return err
+	}
+	bridge, err := net.InterfaceByName(bridgeName)
+	if nil != err {
+		return err
+	}
+	return netlink.AddToBridge(iface, bridge)
+}
+
+// ifaceQueueOpener returns function opening next queue of multiqueue
+// interface (nil without multiqueue)
+func ifaceQueueOpener(iface tunIface, opts ifaceOptions) func() (tunIface, error) {
+	if !opts.MultiQueue {
+		return nil
+	}
+	return func() (tunIface, error) {
+		return openTun(iface.Name(), opts)
+	}
+}
+
+// monitorRoutes returns channel notified on changes of kernel routes (nil
+// channel if they can't be monitored)
+func monitorRoutes() chan struct{} {
+	mon, err := netlink.NewRouteMonitor()
+	if nil != err {
+		log.Println("Unable to monitor kernel routes:", err)
+		return nil
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer mon.Close()
+		for {
+			if err := mon.Wait(); nil != err {
+				log.Println("Monitoring of kernel routes failed:", err)
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
+
+// waitRoutes waits for the rest of burst of kernel route changes
+func waitRoutes(changes chan struct{}) {
+	time.Sleep(routeChangeDelay)
+	select {
+	case <-changes:
+	default:
+	}
+}
+
+// routesThread reconciles kernel routes with config on reload, on change
+// of kernel routes (route deleted by hand, interface flap) and periodically
 func routesThread(ifaceName string, refresh chan bool) {
-	currentRoutes := map[string]bool{}
+	changes := monitorRoutes()
+	ticker := time.NewTicker(routeSyncInterval)
 	for {
-		<-refresh
-		log.Println("Reloading routes...")
-		conf := config.Load().(VPNState)
+		select {
+		case <-refresh:
+			log.Println("Reloading routes...")
+		case <-changes:
+			waitRoutes(changes)
+		case <-ticker.C:
+		}
+		syncRoutes(ifaceName)
+	}
+}
 
-		routes2Del := map[string]bool{}
+var installedRoutes = struct {
+	sync.Mutex
+	stopped bool
+	failed  map[string]string
+}{
+	failed: map[string]string{},
+}
 
-		for r := range currentRoutes {
-			routes2Del[r] = true
+// routeKey identifies kernel route (network, table and metric)
+func routeKey(network string, table, metric int) string {
+	if 0 == table {
+		table = rtTableMain
+	}
+	return fmt.Sprintf("%s table %d metric %d", network, table, metric)
+}
+
+// kernelRoutes returns routes installed by lcvpn via interface
+func kernelRoutes(ifaceName string) (map[string]netlink.Route, error) {
+	routes, err := netlink.NetworkGetAllRoutes()
+	if nil != err {
+		return nil, err
+	}
+	result := map[string]netlink.Route{}
+	for _, r := range routes {
+		if rtProtoLcvpn != r.Protocol || nil == r.IPNet || nil == r.Iface || r.Iface.Name != ifaceName {
+			continue
 		}
+		result[routeKey(r.IPNet.String(), r.Table, r.Metric)] = r
+	}
+	return result, nil
+}
+
+// syncRoutes adds missing routes of config and removes the rest of routes
+// installed by lcvpn
+func syncRoutes(ifaceName string) {
+	installedRoutes.Lock()
+	defer installedRoutes.Unlock()
+	if installedRoutes.stopped {
+		return
+	}
+
+	conf := config.Load().(VPNState)
+	current, err := kernelRoutes(ifaceName)
+	if nil != err {
+		log.Println("Unable to get kernel routes:", err)
+		return
+	}
+
+	wanted := make(map[string]bool, len(conf.routes))
+	for r := range conf.routes {
+		rs := r.String()
+		opts := conf.routeOpts[r]
+		opts.Protocol = rtProtoLcvpn
+		key := routeKey(rs, opts.Table, opts.Metric)
+		wanted[key] = true
 
-		for r := range conf.routes {
-			rs := r.String()
-			if _, exist := routes2Del[rs]; exist {
-				delete(routes2Del, rs)
-			} else {
-				// real add route
-				currentRoutes[rs] = true
-				log.Println("Adding route:", rs)
-				err := netlink.AddRoute(rs, "", "", ifaceName)
-				if nil != err {
-					log.Println("Adding route", rs, "failed:", err)
-				}
+		if kr, ok := current[key]; ok {
+			if kr.Src.Equal(net.ParseIP(opts.src)) {
+				continue
 			}
+			// only preferred source is changed
+			opts.Replace = true
 		}
 
-		for r := range routes2Del {
-			delete(currentRoutes, r)
-			log.Println("Removing route:", r)
-			err := netlink.DelRoute(r, "", "", ifaceName)
-			if nil != err {
-				log.Printf("Error removeing route \"%s\": %s", r, err.Error())
-			}
+		prev, retry := installedRoutes.failed[key]
+		if !retry {
+			log.Println("Adding route:", rs)
+		}
+		err := netlink.AddRouteOpts(rs, opts.src, "", ifaceName, opts.RouteOptions)
+		if nil == err {
+			delete(installedRoutes.failed, key)
+			continue
+		}
+		if prev != err.Error() {
+			log.Println("Adding route", rs, "failed:", err)
 		}
+		installedRoutes.failed[key] = err.Error()
+	}
+
+	for key, kr := range current {
+		if !wanted[key] {
+			delRoute(kr, ifaceName)
+		}
+	}
+	for key := range installedRoutes.failed {
+		if !wanted[key] {
+			delete(installedRoutes.failed, key)
+		}
+	}
+}
+
+// cleanupRoutes removes all routes installed by lcvpn, they are not
+// added anymore
+func cleanupRoutes(ifaceName string) {
+	installedRoutes.Lock()
+	defer installedRoutes.Unlock()
+	installedRoutes.stopped = true
+
+	current, err := kernelRoutes(ifaceName)
+	if nil != err {
+		log.Println("Unable to get kernel routes:", err)
+		return
+	}
+	for _, kr := range current {
+		delRoute(kr, ifaceName)
+	}
+}
+
+func delRoute(kr netlink.Route, ifaceName string) {
+	r := kr.IPNet.String()
+	log.Println("Removing route:", r)
+	err := netlink.DelRouteOpts(r, "", "", ifaceName,
+		netlink.RouteOptions{Table: kr.Table, Metric: kr.Metric, Protocol: kr.Protocol})
+	if nil != err {
+		log.Printf("Error removeing route \"%s\": %s", r, err.Error())
 	}
 }
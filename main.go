@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,10 +10,9 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 
-	"github.com/matishsiao/go_reuseport"
-	"github.com/songgao/water"
 	"golang.org/x/net/ipv4"
 )
 
@@ -28,21 +28,63 @@ const (
 	// BUFFERSIZE is size of buffer to receive packets
 	// (little bit bigger than maximum)
 	BUFFERSIZE = 1518
+
+	// tunnelMSS is maximum TCP segment size which fits into MTU
+	// (20 bytes IPv4 header + 20 bytes TCP header)
+	tunnelMSS = MTU - 40
 )
 
-func rcvrThread(proto string, port int, iface *water.Interface) {
-	conn, err := reuseport.NewReusableUDPPortConn(proto, fmt.Sprintf(":%v", port))
-	if nil != err {
-		log.Fatalln("Unable to get UDP socket:", err)
+// tunIface is local side of tunnel, water interface or own implementation
+type tunIface interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
+// ifaceFlusher is implemented by interfaces which buffer written packets
+// (for coalescing) until Flush
+type ifaceFlusher interface {
+	Flush() error
+}
+
+// ifaceOptions contains optional features of local interface
+type ifaceOptions struct {
+	MultiQueue bool
+	Offload    bool
+	TAP        bool
+	Bridge     string
+}
+
+// flushIface writes buffered packets if iface supports buffering
+func flushIface(iface tunIface) {
+	if f, ok := iface.(ifaceFlusher); ok {
+		if err := f.Flush(); nil != err {
+			log.Println("Error writing to local interface: ", err)
+		}
+	}
+}
+
+// rcvrThread receives datagrams from conn until it's closed
+func rcvrThread(conn net.PacketConn, iface tunIface) {
+	if batch := config.Load().(VPNState).Main.BatchSize; batch > 1 {
+		rcvrBatchLoop(conn, iface, batch)
+		return
+	}
+
+	if config.Load().(VPNState).Main.Pipeline {
+		rcvrPipeline(conn, iface)
+		return
 	}
 
 	encrypted := make([]byte, BUFFERSIZE)
 	var decrypted IPPacket = make([]byte, BUFFERSIZE)
 
 	for {
-		n, _, err := conn.ReadFrom(encrypted)
+		n, from, err := conn.ReadFrom(encrypted)
 
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Println("Error: ", err)
 			continue
 		}
@@ -53,36 +95,184 @@ func rcvrThread(proto string, port int, iface *water.Interface) {
 		}
 
 		conf := config.Load().(VPNState)
+		handleIncoming(&conf, from, encrypted[:n], decrypted, iface)
+		flushIface(iface)
+	}
+}
 
-		if !conf.Main.main.CheckSize(n) {
-			log.Println("invalid packet size ", n)
-			continue
+// handleIncoming decrypts one received datagram and writes it to local interface
+func handleIncoming(conf *VPNState, from net.Addr, encrypted []byte, decrypted IPPacket, iface tunIface) {
+	if data, ok := decryptIncoming(conf, from, encrypted, decrypted); ok {
+		writeIface(iface, data)
+	}
+}
+
+// decryptIncoming decrypts received datagram with main or alt key,
+// returns data to be written to local interface and false if it should be dropped
+func decryptIncoming(conf *VPNState, from net.Addr, encrypted []byte, decrypted IPPacket) ([]byte, bool) {
+	from = conf.remoteAddr(from)
+	p := conf.peerFrom(from)
+	if nil != p && p.acct.isBlocked() {
+		conf.captureDatagram(captureIn, from, encrypted, "quota")
+		return nil, false
+	}
+
+	if conf.obfuscatedFrom(from) {
+		obfuscated := encrypted
+		var ok bool
+		if encrypted, ok = deobfuscate(conf.Main.obfs, encrypted); !ok {
+			log.Println("Invalid obfuscated packet from", from)
+			conf.captureDatagram(captureIn, from, obfuscated, "invalid obfuscation")
+			return nil, false
 		}
+	}
+
+	n := len(encrypted)
+	if !conf.Main.main.CheckSize(n) {
+		log.Println("invalid packet size ", n)
+		conf.captureDatagram(captureIn, from, encrypted, "invalid size")
+		return nil, false
+	}
 
-		size, mainErr := DecryptV4Chk(conf.Main.main, encrypted[:n], decrypted)
-		if nil != mainErr {
-			if nil != conf.Main.alt {
-				size, err = DecryptV4Chk(conf.Main.alt, encrypted[:n], decrypted)
-				if nil != err {
-					log.Println("Corrupted package: ", mainErr, " / ", err)
-					continue
-				}
-			} else {
-				log.Println("Corrupted package: ", mainErr)
-				continue
+	size, mainErr := DecryptMsgChk(conf.Main.main, encrypted, decrypted)
+	if nil != mainErr {
+		if nil != conf.Main.alt {
+			var err error
+			size, err = DecryptMsgChk(conf.Main.alt, encrypted, decrypted)
+			if nil != err {
+				log.Println("Corrupted package: ", mainErr, " / ", err)
+				conf.captureDatagram(captureIn, from, encrypted, "corrupted")
+				return nil, false
 			}
+		} else {
+			log.Println("Corrupted package: ", mainErr)
+			conf.captureDatagram(captureIn, from, encrypted, "corrupted")
+			return nil, false
 		}
+	}
+	// only authenticated datagrams are accounted (same size as sent)
+	if nil != p {
+		p.acct.addIn(n)
+	}
+	conf.captureDatagram(captureIn, from, encrypted, "")
+
+	return unwrapMsg(conf, from, decrypted, size)
+}
 
-		n, err = iface.Write(decrypted[:size])
+// unwrapMsg removes sequence and FEC wrappers of message and processes it
+func unwrapMsg(conf *VPNState, from net.Addr, decrypted IPPacket, size int) ([]byte, bool) {
+	if msgSeq == msgType(decrypted) {
+		// written in order by reorderThread
+		seqUnwrap(conf, from, decrypted, size)
+		return nil, false
+	}
+
+	if msgFEC == msgType(decrypted) {
+		n, err := fecUnwrap(from, decrypted, size)
 		if nil != err {
-			log.Println("Error writing to local interface: ", err)
-		} else if n != size {
-			log.Println("Partial package written to local interface")
+			log.Println(err)
+			conf.captureIncoming(from, decrypted[:size], "invalid FEC")
+			return nil, false
+		}
+		if 0 == n {
+			// parity is only stored
+			return nil, false
+		}
+		size = n
+	}
+
+	return processMsg(conf, from, decrypted, size)
+}
+
+// processMsg handles decrypted message, returns data to be written
+// to local interface and false if there is nothing to write
+func processMsg(conf *VPNState, from net.Addr, decrypted IPPacket, size int) ([]byte, bool) {
+	if msgCompressed == msgType(decrypted) {
+		n, ok := decompressMsg(decrypted, size)
+		if !ok {
+			conf.captureIncoming(from, decrypted[:size], "invalid compression")
+			return nil, false
+		}
+		size = n
+	}
+
+	switch msgType(decrypted) {
+	case msgIPv4:
+		if conf.Main.tap {
+			log.Println("IPv4 packet received in tap mode")
+			conf.captureIncoming(from, decrypted[:size], "IPv4 in tap mode")
+			return nil, false
+		}
+		if conf.Main.MSSClamp {
+			decrypted.ClampMSS(tunnelMSS)
+		}
+		if p := conf.peerFrom(from); nil != p {
+			p.accountIncoming(decrypted, size)
+		}
+		conf.captureIncoming(from, decrypted[:size], "")
+		return decrypted[:size], true
+
+	case msgEthernet:
+		frame := decrypted[msgHeaderLen:size]
+		if !conf.Main.tap || len(frame) < ethHeaderLen {
+			log.Println("Unexpected ethernet frame received")
+			conf.captureIncoming(from, decrypted[:size], "unexpected frame")
+			return nil, false
 		}
+		conf.learnFrame(frame, from)
+		conf.captureIncoming(from, decrypted[:size], "")
+		return frame, true
+
+	case msgControl:
+		handleControl(conf, from, decrypted[:size])
+	}
+
+	return nil, false
+}
+
+// readIface reads next packet from local interface to buf,
+// ethernet frame (tap mode) is stored after message header
+func readIface(iface tunIface, buf []byte, tap bool) (int, error) {
+	if !tap {
+		return iface.Read(buf[:MTU])
+	}
+
+	n, err := iface.Read(buf[msgHeaderLen : msgHeaderLen+MTU+ethHeaderLen])
+	if nil != err {
+		return 0, err
 	}
+	putMsgHeader(buf, msgEthernet, msgHeaderLen+n)
+	return msgHeaderLen + n, nil
 }
 
-func sndrThread(conn *net.UDPConn, iface *water.Interface) {
+// writeIface writes decrypted packet to local interface
+func writeIface(iface tunIface, packet []byte) {
+	n, err := iface.Write(packet)
+	if nil != err {
+		log.Println("Error writing to local interface: ", err)
+	} else if n != len(packet) {
+		log.Println("Partial package written to local interface")
+	}
+}
+
+// sndrThread reads packets from local interface and sends them to remotes,
+// it exits after next packet when stop is set
+func sndrThread(conn *net.UDPConn, iface tunIface, stop *atomic.Bool) {
+	if config.Load().(VPNState).Main.qos {
+		sndrQoS(conn, iface, stop)
+		return
+	}
+
+	if batch := config.Load().(VPNState).Main.BatchSize; batch > 1 {
+		sndrBatchLoop(conn, iface, batch, stop)
+		return
+	}
+
+	if config.Load().(VPNState).Main.Pipeline {
+		sndrPipeline(conn, iface, stop)
+		return
+	}
+
 	// first time fill with random numbers
 	ivbuf := make([]byte, config.Load().(VPNState).Main.main.IVLen())
 	if _, err := io.ReadFull(rand.Reader, ivbuf); err != nil {
@@ -91,90 +281,155 @@ func sndrThread(conn *net.UDPConn, iface *water.Interface) {
 
 	var packet IPPacket = make([]byte, BUFFERSIZE)
 	var encrypted = make([]byte, BUFFERSIZE)
+	tap := isTAP(iface)
 
 	for {
-		plen, err := iface.Read(packet[:MTU])
+		plen, err := readIface(iface, packet, tap)
 		if err != nil {
 			break
 		}
 
-		if 4 != packet.IPver() {
-			header, _ := ipv4.ParseHeader(packet)
-			log.Printf("Non IPv4 packet [%+v]\n", header)
-			continue
-		}
-
 		// each time get pointer to (probably) new config
 		c := config.Load().(VPNState)
 
-		dst := packet.Dst()
+		tsize, dsts := prepareOutgoing(&c, packet[:plen], encrypted, ivbuf)
 
-		wanted := false
-
-		addr, ok := c.remotes[dst]
-
-		if ok {
-			wanted = true
+		for _, addr := range dsts {
+			n, err := c.sendTo(conn, encrypted[:tsize], addr)
+			if nil != err {
+				log.Println("Error sending package:", err)
+			}
+			if n != tsize {
+				log.Println("Only ", n, " bytes of ", tsize, " sent")
+			}
 		}
 
-		if dst == c.Main.bcastIP || packet.IsMulticast() {
-			wanted = true
+		if stop.Load() {
+			return
 		}
+	}
+
+}
+
+// prepareOutgoing selects destinations for packet read from local interface
+// and encrypts it into encrypted buffer, returns size of encrypted data
+// and list of remotes (empty if packet should be dropped)
+func prepareOutgoing(c *VPNState, packet IPPacket, encrypted []byte, ivbuf []byte) (int, []*net.UDPAddr) {
+	dsts := c.outgoingDsts(packet)
+	if 0 == len(dsts) {
+		return 0, nil
+	}
+
+	tsize := sealOutgoing(c, dsts, packet, encrypted, ivbuf)
+	if 0 == tsize {
+		return 0, nil
+	}
+	return tsize, dsts
+}
 
+// outgoingDsts returns remotes for packet (or ethernet message) read
+// from local interface
+func (c *VPNState) outgoingDsts(packet IPPacket) []*net.UDPAddr {
+	if msgEthernet == msgType(packet) {
+		dsts := c.frameDsts(packet[msgHeaderLen:])
+		c.captureOutgoing(dsts, packet, "")
+		return dsts
+	}
+
+	if 4 != packet.IPver() {
+		header, _ := ipv4.ParseHeader(packet)
+		log.Printf("Non IPv4 packet [%+v]\n", header)
+		c.captureOutgoing(nil, packet, "non IPv4")
+		return nil
+	}
+
+	var dsts []*net.UDPAddr
+
+	dst := packet.Dst()
+
+	if addr, ok := c.remotes[dst]; ok {
+		dsts = []*net.UDPAddr{addr}
+	} else if dst == c.Main.bcastIP {
+		dsts = c.bcastList
+	} else if packet.IsMulticast() {
+		dsts = c.multicastDsts(packet)
+	} else {
 		// very ugly and useful only for a limited numbers of routes!
-		if !wanted {
-			ip := packet.DstV4()
-			for n, s := range c.routes {
-				if n.Contains(ip) {
-					addr = s
-					ok = true
-					wanted = true
-					break
-				}
+		ip := packet.DstV4()
+		for n, s := range c.routes {
+			if n.Contains(ip) {
+				dsts = []*net.UDPAddr{s}
+				c.routeAcct[n].addOut(len(packet))
+				break
 			}
 		}
+	}
+
+	if 0 == len(dsts) {
+		if !packet.IsMulticast() && dst != c.Main.bcastIP {
+			log.Println("Unknown dst: ", dst)
+		}
+		c.captureOutgoing(nil, packet, "no remote")
+		return nil
+	}
+	c.captureOutgoing(dsts, packet, "")
+	return dsts
+}
 
-		if wanted {
-			// new len contatins also 2byte original size
-			clen := c.Main.main.AdjustInputSize(plen)
+// sealOutgoing clamps MSS, wraps and encrypts packet for dsts,
+// returns size of encrypted datagram (0 on error)
+func sealOutgoing(c *VPNState, dsts []*net.UDPAddr, packet IPPacket, encrypted []byte, ivbuf []byte) int {
+	plen := len(packet)
+	// restore full buffer, encryption may need padding space
+	packet = packet[:cap(packet)]
 
-			if clen+c.Main.main.OutputAdd() > len(packet) {
-				log.Println("clen + data > len(package)", clen, len(packet))
-				continue
-			}
+	if msgIPv4 == msgType(packet) && c.Main.MSSClamp {
+		packet.ClampMSS(tunnelMSS)
+	}
+
+	plen = c.wrapOutgoing(dsts, packet, plen)
+	return encryptOutgoing(c, packet, plen, encrypted, ivbuf)
+}
 
-			tsize := c.Main.main.Encrypt(packet[:clen], encrypted, ivbuf)
-
-			if ok {
-				n, err := conn.WriteToUDP(encrypted[:tsize], addr)
-				if nil != err {
-					log.Println("Error sending package:", err)
-				}
-				if n != tsize {
-					log.Println("Only ", n, " bytes of ", tsize, " sent")
-				}
-			} else {
-				// multicast or broadcast
-				for _, addr := range c.remotes {
-					n, err := conn.WriteToUDP(encrypted[:tsize], addr)
-					if nil != err {
-						log.Println("Error sending package:", err)
-					}
-					if n != tsize {
-						log.Println("Only ", n, " bytes of ", tsize, " sent")
-					}
-				}
+// wrapOutgoing applies compression, FEC, sequencing and padding to message for dsts,
+// returns new length of message
+func (c *VPNState) wrapOutgoing(dsts []*net.UDPAddr, packet []byte, plen int) int {
+	if c.compressFor(dsts) {
+		plen = compressMsg(packet, plen)
+	}
+	if 1 == len(dsts) {
+		if p, ok := c.peers[dsts[0]]; ok {
+			if p.fec.data > 0 {
+				plen = fecWrap(c, dsts[0], p.fec, packet, plen)
+			}
+			if p.sequenced() {
+				plen = seqWrap(c, dsts[0], packet, plen)
 			}
-		} else {
-			log.Println("Unknown dst: ", dst)
 		}
 	}
+	if padding := c.paddingFor(dsts); padding.enabled() {
+		plen = padMsg(padding, packet, plen)
+	}
+	return plen
+}
+
+// encryptOutgoing encrypts first plen bytes of packet, returns 0 on error
+func encryptOutgoing(c *VPNState, packet []byte, plen int, encrypted []byte, ivbuf []byte) int {
+	// new len contatins also 2byte original size
+	clen := c.Main.main.AdjustInputSize(plen)
+
+	if clen+c.Main.main.OutputAdd() > len(packet) {
+		log.Println("clen + data > len(package)", clen, len(packet))
+		return 0
+	}
 
+	return c.Main.main.Encrypt(packet[:clen], encrypted, ivbuf)
 }
 
 func main() {
 
 	version := flag.Bool("version", false, "print lcvpn version")
+	showAccounting := flag.Bool("accounting", false, "print traffic counters from accounting file")
 	flag.Parse()
 
 	if *version {
@@ -182,24 +437,70 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *showAccounting {
+		// only main section is needed, config isn't prepared
+		var c VPNState
+		if err := loadConfigFile(*configfile, &c); nil != err {
+			log.Fatalln("Error loading config:", err)
+		}
+		file := c.Main.AccountingFile
+		if "" == file {
+			log.Fatalln("main.accountingFile is not set in config")
+		}
+		if err := printAccounting(os.Stdout, file); nil != err {
+			log.Fatalln("Unable to read accounting:", err)
+		}
+		os.Exit(0)
+	}
+
+	if "checkconfig" == flag.Arg(0) {
+		problems := validateConfig(*configfile, *local)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if 0 != len(problems) {
+			os.Exit(1)
+		}
+		fmt.Println("Config is OK")
+		os.Exit(0)
+	}
+
 	routeReload := make(chan bool, 1)
 
 	initConfig(routeReload)
 
 	conf := config.Load().(VPNState)
 
-	iface := ifaceSetup(conf.Main.local)
+	if "" != conf.Main.AccountingFile {
+		if err := loadAccounting(conf.Main.AccountingFile); nil != err {
+			log.Fatalln("Unable to load accounting:", err)
+		}
+	}
+	go accountingThread()
+	go captureThread()
+
+	ifaceOpts := ifaceOptions{
+		MultiQueue: conf.Main.MultiQueue,
+		Offload:    conf.Main.Offload,
+		TAP:        conf.Main.tap,
+		Bridge:     conf.Main.Bridge,
+	}
+	iface := ifaceSetup(conf.Main.local, ifaceOpts)
+
+	go statsThread()
 
 	// start routes changes in config monitoring
 	go routesThread(iface.Name(), routeReload)
 
-	log.Println("Interface parameters configured")
+	// export of selected kernel routes to remotes
+	go routeExportThread(iface.Name())
 
-	// Start listen threads
-	for i := 0; i < conf.Main.RecvThreads; i++ {
-		go rcvrThread("udp4", conf.Main.Port, iface)
+	if conf.Main.tap {
+		go macExpireThread()
 	}
 
+	log.Println("Interface parameters configured")
+
 	// init udp socket for write
 
 	writeAddr, err := net.ResolveUDPAddr("udp", ":")
@@ -212,19 +513,45 @@ func main() {
 		log.Fatalln("Unable to create UDP socket:", err)
 	}
 
-	// Start sender threads
-
-	for i := 0; i < conf.Main.SendThreads; i++ {
-		go sndrThread(writeConn, iface)
+	// control messages between peers
+	ctrl = newControlSender(writeConn)
+	go controlThread(ctrl)
+
+	// FEC parity for not completed blocks and recovered packets
+	go fecFlushThread()
+	go fecRecoveredThread(iface)
+
+	// multipath probes and restoring order of messages
+	go pathProbeThread()
+	go reorderThread(iface)
+
+	// Start listen and sender threads of UDP and listeners of TCP and TLS
+	// transports, they are updated on reload
+	reloadLock.Lock()
+	conf = config.Load().(VPNState)
+	// in multiqueue mode each sender opens own queue
+	workers.Store(newWorkerSet(writeConn, []tunIface{iface}, ifaceQueueOpener(iface, ifaceOpts), &conf))
+	initTransports(iface)
+	if err := applyTransports(&conf); nil != err {
+		log.Fatalln("Unable to start transports:", err)
 	}
+	reloadLock.Unlock()
 
 	exitChan := make(chan os.Signal, 1)
 	signal.Notify(exitChan, syscall.SIGTERM)
 
 	<-exitChan
 
+	cleanupRoutes(iface.Name())
+
 	err = writeConn.Close()
 	if nil != err {
 		log.Println("Error closing UDP connection: ", err)
 	}
+
+	if file := config.Load().(VPNState).Main.AccountingFile; "" != file {
+		if err := saveAccounting(file); nil != err {
+			log.Println("Unable to save accounting:", err)
+		}
+	}
 }
@@ -0,0 +1,40 @@
+package main
+
+// Decrypted payload is either plain IPv4 packet (first nibble is 4) or
+// lcvpn message with 4 bytes header [type << 4, 0, size (2 bytes)],
+// size includes header and is stored at same place as IPv4 total length,
+// so padding added by encryption can be removed same way for all of them
+
+const (
+	// msgHeaderLen is size of lcvpn message header
+	msgHeaderLen = 4
+
+	msgCompressed = 1
+	msgFEC        = 2
+	msgControl    = 3
+	msgIPv4       = 4
+	msgEthernet   = 5
+	msgSeq        = 6
+)
+
+// msgType returns type of decrypted message (msgIPv4 for plain IPv4 packet)
+func msgType(p []byte) int {
+	return int(p[0] >> 4)
+}
+
+// knownMsgType returns true if message of type t can be received
+func knownMsgType(t int) bool {
+	switch t {
+	case msgCompressed, msgFEC, msgControl, msgIPv4, msgEthernet, msgSeq:
+		return true
+	}
+	return false
+}
+
+// putMsgHeader fills message header for message of size bytes (with header)
+func putMsgHeader(p []byte, t int, size int) {
+	p[0] = byte(t << 4)
+	p[1] = 0
+	p[2] = byte(size >> 8)
+	p[3] = byte(size)
+}
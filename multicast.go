@@ -0,0 +1,242 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// ctrlMulticast is control message with list of multicast groups
+	// having listeners behind sender
+	ctrlMulticast = 1
+
+	igmpProto = 2
+
+	igmpV1Report = 0x12
+	igmpV2Report = 0x16
+	igmpV2Leave  = 0x17
+	igmpV3Report = 0x22
+
+	igmpV3IsInclude = 1
+	igmpV3IsExclude = 2
+	igmpV3ToInclude = 3
+	igmpV3ToExclude = 4
+	igmpV3Allow     = 5
+
+	// igmpMembershipTimeout is IGMP group membership interval (with default
+	// query interval), joins not refreshed by reports expire after it
+	igmpMembershipTimeout = 260 * time.Second
+
+	// igmpLastMemberTime is time for other listeners to answer group
+	// specific query of querier after leave
+	igmpLastMemberTime = 2 * time.Second
+)
+
+// mcastMembership contains multicast groups joined by local hosts (snooped
+// from IGMP) and groups announced by remotes
+type mcastMembership struct {
+	sync.RWMutex
+	local  map[[4]byte]map[[4]byte]time.Time // group -> reporter ip -> expires
+	remote map[[4]byte]map[[4]byte]time.Time // group -> remote ext ip -> seen
+}
+
+var mcast = mcastMembership{
+	local:  map[[4]byte]map[[4]byte]time.Time{},
+	remote: map[[4]byte]map[[4]byte]time.Time{},
+}
+
+// isLinkLocalMulticast returns true for 224.0.0.0/24 which is always
+// sent to all remotes (routing protocols and so on)
+func isLinkLocalMulticast(group [4]byte) bool {
+	return 224 == group[0] && 0 == group[1] && 0 == group[2]
+}
+
+// multicastDsts returns remotes which have listeners for multicast packet,
+// IGMP messages of local hosts are consumed
+func (c *VPNState) multicastDsts(packet IPPacket) []*net.UDPAddr {
+	if !c.Main.MulticastSnooping {
+		return c.remoteList
+	}
+
+	if igmpProto == packet[9] {
+		snoopIGMP(packet)
+		return nil
+	}
+
+	group := packet.Dst()
+	if isLinkLocalMulticast(group) {
+		return c.remoteList
+	}
+
+	mcast.RLock()
+	defer mcast.RUnlock()
+
+	var dsts []*net.UDPAddr
+	for ext, seen := range mcast.remote[group] {
+		if time.Since(seen) > controlTTL {
+			continue
+		}
+		if addr, ok := c.extRemotes[ext]; ok {
+			dsts = append(dsts, addr)
+		}
+	}
+	return dsts
+}
+
+// snoopIGMP updates local membership from IGMP report or leave
+func snoopIGMP(packet IPPacket) {
+	ihl := int(packet[0]&0x0f) * 4
+	size := packet.GetSize()
+	if size > len(packet) || ihl+8 > size {
+		return
+	}
+	igmp := packet[ihl:size]
+
+	var joined, left [][4]byte
+	switch igmp[0] {
+	case igmpV1Report, igmpV2Report:
+		joined = append(joined, [4]byte{igmp[4], igmp[5], igmp[6], igmp[7]})
+	case igmpV2Leave:
+		left = append(left, [4]byte{igmp[4], igmp[5], igmp[6], igmp[7]})
+	case igmpV3Report:
+		records := int(igmp[6])<<8 | int(igmp[7])
+		for i, off := 0, 8; i < records && off+8 <= len(igmp); i++ {
+			rtype := igmp[off]
+			sources := int(igmp[off+2])<<8 | int(igmp[off+3])
+			group := [4]byte{igmp[off+4], igmp[off+5], igmp[off+6], igmp[off+7]}
+			switch {
+			case igmpV3IsExclude == rtype || igmpV3ToExclude == rtype:
+				joined = append(joined, group)
+			case (igmpV3IsInclude == rtype || igmpV3Allow == rtype) && sources > 0:
+				joined = append(joined, group)
+			case igmpV3ToInclude == rtype && 0 == sources:
+				left = append(left, group)
+			}
+			off += 8 + 4*sources + 4*int(igmp[off+1])
+		}
+	default:
+		return
+	}
+
+	// joins are kept per reporter, leave only shortens join of its sender
+	// (other listeners could have suppressed their reports)
+	reporter := [4]byte{packet[12], packet[13], packet[14], packet[15]}
+	now := time.Now()
+	joinedNew, leaving := false, false
+
+	mcast.Lock()
+	for _, g := range joined {
+		if isLinkLocalMulticast(g) {
+			continue
+		}
+		reporters := mcast.local[g]
+		if nil == reporters {
+			reporters = map[[4]byte]time.Time{}
+			mcast.local[g] = reporters
+		}
+		if !activeGroup(reporters, now) {
+			log.Println("Multicast group joined:", net.IP(g[:]))
+			joinedNew = true
+		}
+		reporters[reporter] = now.Add(igmpMembershipTimeout)
+	}
+	for _, g := range left {
+		if expires, ok := mcast.local[g][reporter]; ok && expires.After(now.Add(igmpLastMemberTime)) {
+			mcast.local[g][reporter] = now.Add(igmpLastMemberTime)
+			leaving = true
+		}
+	}
+	mcast.Unlock()
+
+	if nil == ctrl {
+		return
+	}
+	if joinedNew {
+		ctrl.Announce(ctrlMulticast)
+	}
+	if leaving {
+		time.AfterFunc(igmpLastMemberTime, func() { ctrl.Announce(ctrlMulticast) })
+	}
+}
+
+// activeGroup returns true if any join of group isn't expired
+func activeGroup(reporters map[[4]byte]time.Time, now time.Time) bool {
+	for _, expires := range reporters {
+		if now.Before(expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// localGroups returns groups joined by local hosts, expired joins are removed
+func localGroups(now time.Time) [][4]byte {
+	mcast.Lock()
+	defer mcast.Unlock()
+
+	groups := make([][4]byte, 0, len(mcast.local))
+	for g, reporters := range mcast.local {
+		for r, expires := range reporters {
+			if !now.Before(expires) {
+				delete(reporters, r)
+			}
+		}
+		if 0 == len(reporters) {
+			log.Println("Multicast group left:", net.IP(g[:]))
+			delete(mcast.local, g)
+			continue
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// announceMulticast sends list of locally joined groups to all remotes,
+// joins expired since last announcement are dropped
+func announceMulticast(c *VPNState, s *controlSender) {
+	if !c.Main.MulticastSnooping {
+		return
+	}
+
+	groups := localGroups(time.Now())
+	payload := make([]byte, 0, 4*len(groups))
+	for _, g := range groups {
+		if len(payload)+4 > maxControlPayload() {
+			log.Println("Too many multicast groups, not all are announced")
+			break
+		}
+		payload = append(payload, g[:]...)
+	}
+
+	s.Send(c, ctrlMulticast, payload, c.remoteList)
+}
+
+// handleMulticast replaces groups announced by remote
+func handleMulticast(c *VPNState, from [4]byte, payload []byte) {
+	now := time.Now()
+
+	mcast.Lock()
+	defer mcast.Unlock()
+
+	for g, remotes := range mcast.remote {
+		delete(remotes, from)
+		if 0 == len(remotes) {
+			delete(mcast.remote, g)
+		}
+	}
+
+	for ; len(payload) >= 4; payload = payload[4:] {
+		g := [4]byte{payload[0], payload[1], payload[2], payload[3]}
+		if nil == mcast.remote[g] {
+			mcast.remote[g] = map[[4]byte]time.Time{}
+		}
+		mcast.remote[g][from] = now
+	}
+}
+
+func init() {
+	registeredControls[ctrlMulticast] = handleMulticast
+	registeredAnnouncers[ctrlMulticast] = announceMulticast
+}
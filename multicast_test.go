@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSnoopIGMP(t *testing.T) {
+	// IGMPv2 report and leave for 239.1.2.3 with router alert option
+	report := IPPacket([]byte{0x46, 0xc0, 0x00, 0x20, 0x00, 0x00, 0x40, 0x00, 0x01, 0x02, 0x00, 0x00,
+		0xc0, 0xa8, 0x03, 0x0f, 0xef, 0x01, 0x02, 0x03, 0x94, 0x04, 0x00, 0x00,
+		igmpV2Report, 0x00, 0x00, 0x00, 0xef, 0x01, 0x02, 0x03})
+	leave := append(IPPacket{}, report...)
+	leave[24] = igmpV2Leave
+
+	group := [4]byte{239, 1, 2, 3}
+	joined := func(now time.Time) bool {
+		for _, g := range localGroups(now) {
+			if g == group {
+				return true
+			}
+		}
+		return false
+	}
+
+	// second listener (.16) joined too, leave of first one keeps group
+	other := append(IPPacket{}, report...)
+	other[15] = 0x10
+	now := time.Now()
+	snoopIGMP(report)
+	snoopIGMP(other)
+	snoopIGMP(leave)
+	if !joined(now.Add(igmpLastMemberTime + time.Second)) {
+		t.Error("group of other listener left")
+	}
+	if joined(now.Add(igmpMembershipTimeout + time.Second)) {
+		t.Error("not refreshed group not expired")
+	}
+
+	// last listener leaves after time for answers to querier
+	snoopIGMP(report)
+	snoopIGMP(leave)
+	if !joined(time.Now()) {
+		t.Error("group left before last member time")
+	}
+	if joined(time.Now().Add(igmpLastMemberTime + time.Second)) {
+		t.Error("group still joined after leave")
+	}
+
+	// IGMPv3 TO_INCLUDE{} is leave of its sender only
+	v3 := func(src byte, rtype byte) IPPacket {
+		p := IPPacket([]byte{0x45, 0xc0, 0x00, 0x24, 0x00, 0x00, 0x40, 0x00, 0x01, 0x02, 0x00, 0x00,
+			0xc0, 0xa8, 0x03, src, 0xe0, 0x00, 0x00, 0x16,
+			igmpV3Report, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+			rtype, 0x00, 0x00, 0x00, 0xef, 0x01, 0x02, 0x03})
+		return p
+	}
+	snoopIGMP(v3(0x0f, igmpV3ToExclude))
+	snoopIGMP(v3(0x10, igmpV3IsExclude))
+	snoopIGMP(v3(0x0f, igmpV3ToInclude))
+	if !joined(time.Now().Add(igmpLastMemberTime + time.Second)) {
+		t.Error("TO_INCLUDE{} removed group of other listener")
+	}
+	localGroups(time.Now().Add(igmpMembershipTimeout + time.Second))
+}
+
+func TestVPNState_multicastDsts(t *testing.T) {
+	prague := &net.UDPAddr{IP: net.ParseIP("46.234.105.229"), Port: 23456}
+	berlin := &net.UDPAddr{IP: net.ParseIP("103.224.182.245"), Port: 23456}
+	c := VPNState{
+		remoteList: []*net.UDPAddr{prague, berlin},
+		extRemotes: map[[4]byte]*net.UDPAddr{
+			{46, 234, 105, 229}:  prague,
+			{103, 224, 182, 245}: berlin,
+		},
+	}
+	c.Main.MulticastSnooping = true
+
+	handleMulticast(&c, [4]byte{103, 224, 182, 245}, []byte{239, 1, 1, 1})
+
+	packet := func(dst ...byte) IPPacket {
+		p := append(IPPacket{}, testICMPPing...)
+		copy(p[16:20], dst)
+		return p
+	}
+
+	tests := []struct {
+		name string
+		p    IPPacket
+		want int
+	}{
+		{
+			name: "joined by berlin",
+			p:    packet(239, 1, 1, 1),
+			want: 1,
+		},
+		{
+			name: "no listeners",
+			p:    packet(239, 1, 1, 2),
+			want: 0,
+		},
+		{
+			name: "link local",
+			p:    packet(224, 0, 0, 5),
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.multicastDsts(tt.p); len(got) != tt.want {
+				t.Errorf("VPNState.multicastDsts() returned %d remotes, want %d", len(got), tt.want)
+			}
+		})
+	}
+
+	// empty announcement removes groups of remote
+	handleMulticast(&c, [4]byte{103, 224, 182, 245}, nil)
+	if got := c.multicastDsts(packet(239, 1, 1, 1)); 0 != len(got) {
+		t.Errorf("VPNState.multicastDsts() returned %d remotes after leave, want 0", len(got))
+	}
+}
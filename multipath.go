@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Remote with several external addresses (or host with several local bind
+// addresses) is reached by multiple paths, path is pair of local socket and
+// remote address. Bind sockets are opened on main port by workerSet and
+// read as other receivers. Each path is probed by control message which
+// remote answers (by any path), path without answer for pathDeadTimeout is
+// not used. In roundrobin and redundant modes messages are wrapped into
+// msgSeq messages with sequence number, so receiver can restore order and
+// drop duplicates: [sender LocIP (4 bytes)][sequence (4 bytes)] follows
+// message header, so order is kept per remote whatever address it sends from.
+
+const (
+	multipathFailover   = "failover"
+	multipathRoundRobin = "roundrobin"
+	multipathRedundant  = "redundant"
+
+	// ctrlPathProbe is probe sent by each path, ctrlPathReply is answer to it
+	ctrlPathProbe = 2
+	ctrlPathReply = 3
+
+	pathProbeInterval = time.Second
+	pathDeadTimeout   = 3 * pathProbeInterval
+
+	seqHeaderLen = 8
+
+	// reorderWindow is maximum number of messages waiting for missing one
+	reorderWindow = 64
+
+	// reorderTimeout is maximum time to wait for missing message
+	reorderTimeout = 20 * time.Millisecond
+)
+
+var eSeqInvalid = errors.New("Invalid sequenced message")
+
+// pathState is kept between config reloads
+type pathState struct {
+	id        uint32
+	name      string
+	lastReply int64 // unix nanoseconds
+	rtt       int64 // nanoseconds
+	sent      uint64
+}
+
+func (s *pathState) alive(now int64) bool {
+	return now-atomic.LoadInt64(&s.lastReply) < int64(pathDeadTimeout)
+}
+
+// pathInfo is one path to remote
+type pathInfo struct {
+	bind   string // local address, "" means default socket
+	addr   *net.UDPAddr
+	weight int
+	state  *pathState
+}
+
+var pathRegistry = struct {
+	sync.Mutex
+	byName map[string]*pathState
+	byID   []*pathState
+}{
+	byName: map[string]*pathState{},
+}
+
+func getPathState(name string) *pathState {
+	pathRegistry.Lock()
+	defer pathRegistry.Unlock()
+
+	s, ok := pathRegistry.byName[name]
+	if !ok {
+		s = &pathState{id: uint32(len(pathRegistry.byID)), name: name}
+		pathRegistry.byName[name] = s
+		pathRegistry.byID = append(pathRegistry.byID, s)
+	}
+	return s
+}
+
+// bindConns are sockets of bind addresses opened by workerSet
+var bindConns atomic.Pointer[map[string]*net.UDPConn]
+
+// bindConn returns socket bound to local address ip, nil if it isn't open
+func bindConn(ip string) *net.UDPConn {
+	if m := bindConns.Load(); nil != m {
+		return (*m)[ip]
+	}
+	return nil
+}
+
+// parsePaths returns paths to remote with main address addr and additional
+// addresses extra ("ip" or "ip weight") from each of local binds
+func parsePaths(addr *net.UDPAddr, extra []string, binds []string) ([]pathInfo, error) {
+	type endpoint struct {
+		addr   *net.UDPAddr
+		weight int
+	}
+	endpoints := []endpoint{{addr: addr, weight: 1}}
+	for _, e := range extra {
+		fields := strings.Fields(e)
+		if 0 == len(fields) || len(fields) > 2 {
+			return nil, fmt.Errorf("path \"%s\" must be in \"ip [weight]\" format", e)
+		}
+		ip := net.ParseIP(fields[0])
+		if nil == ip || nil == ip.To4() {
+			return nil, fmt.Errorf("invalid path address %s", fields[0])
+		}
+		weight := 1
+		if 2 == len(fields) {
+			var err error
+			if weight, err = strconv.Atoi(fields[1]); nil != err || weight < 1 {
+				return nil, fmt.Errorf("invalid path weight %s", fields[1])
+			}
+		}
+		endpoints = append(endpoints, endpoint{
+			addr:   &net.UDPAddr{IP: ip.To4(), Port: addr.Port},
+			weight: weight,
+		})
+	}
+
+	locals := binds
+	if 0 == len(locals) {
+		locals = []string{""}
+	}
+
+	var result []pathInfo
+	for _, e := range endpoints {
+		for _, l := range locals {
+			p := pathInfo{addr: e.addr, weight: e.weight}
+			name := "*"
+			if "" != l {
+				if nil == net.ParseIP(l).To4() {
+					return nil, fmt.Errorf("invalid bind address %s", l)
+				}
+				p.bind = l
+				name = l
+			}
+			p.state = getPathState(name + ">" + e.addr.String())
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// validMultipath returns true if mode is known multipath mode
+func validMultipath(mode string) bool {
+	switch mode {
+	case "", multipathFailover, multipathRoundRobin, multipathRedundant:
+		return true
+	}
+	return false
+}
+
+// sequenced returns true if messages to remote are sent by several paths
+// at once and receiver have to restore their order
+func (p *peerInfo) sequenced() bool {
+	return len(p.paths) > 1 &&
+		(multipathRoundRobin == p.multipath || multipathRedundant == p.multipath)
+}
+
+// selectPaths returns paths for next datagram to remote, if no path is
+// known to be alive all of them are used as alive
+func (p *peerInfo) selectPaths() []pathInfo {
+	if len(p.paths) < 2 {
+		return p.paths
+	}
+
+	now := time.Now().UnixNano()
+	alive := func(i int) bool { return p.paths[i].state.alive(now) }
+	found := false
+	for i := range p.paths {
+		if alive(i) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		alive = func(int) bool { return true }
+	}
+
+	switch p.multipath {
+	case multipathRedundant:
+		result := make([]pathInfo, 0, len(p.paths))
+		for i := range p.paths {
+			if alive(i) {
+				result = append(result, p.paths[i])
+			}
+		}
+		return result
+	case multipathRoundRobin:
+		total := 0
+		for i := range p.paths {
+			if alive(i) {
+				total += p.paths[i].weight
+			}
+		}
+		n := int(atomic.AddUint32(&p.rr, 1) % uint32(total))
+		for i := range p.paths {
+			if !alive(i) {
+				continue
+			}
+			if n < p.paths[i].weight {
+				return p.paths[i : i+1]
+			}
+			n -= p.paths[i].weight
+		}
+	}
+
+	for i := range p.paths {
+		if alive(i) {
+			return p.paths[i : i+1]
+		}
+	}
+	return p.paths[:1]
+}
+
+// remoteAddr returns configured address of remote which sent datagram
+// (datagrams can come from any of its paths)
+func (c *VPNState) remoteAddr(from net.Addr) net.Addr {
+	if key, ok := extKey(from); ok {
+		if addr, ok := c.extRemotes[key]; ok {
+			return addr
+		}
+	}
+	return from
+}
+
+// seqCounters are kept between config reloads
+var seqCounters = struct {
+	sync.Mutex
+	m map[[4]byte]*uint32
+}{m: map[[4]byte]*uint32{}}
+
+func nextSeq(addr *net.UDPAddr) uint32 {
+	key, _ := extKey(addr)
+
+	seqCounters.Lock()
+	counter, ok := seqCounters.m[key]
+	if !ok {
+		counter = new(uint32)
+		*counter = rand.Uint32()
+		seqCounters.m[key] = counter
+	}
+	seqCounters.Unlock()
+
+	return atomic.AddUint32(counter, 1)
+}
+
+// seqWrap wraps message to remote addr into msgSeq message
+func seqWrap(c *VPNState, addr *net.UDPAddr, packet []byte, plen int) int {
+	size := plen + msgHeaderLen + seqHeaderLen
+	if size > len(packet) {
+		return plen
+	}
+
+	copy(packet[msgHeaderLen+seqHeaderLen:], packet[:plen])
+	putMsgHeader(packet, msgSeq, size)
+	copy(packet[msgHeaderLen:], c.Main.locIP[:])
+	binary.BigEndian.PutUint32(packet[msgHeaderLen+4:], nextSeq(addr))
+	return size
+}
+
+var seqStats struct {
+	reordered  uint64
+	duplicates uint64
+	lost       uint64
+}
+
+// reorderBuffer restores order of messages from one remote
+type reorderBuffer struct {
+	sync.Mutex
+	from    net.Addr
+	started bool
+	next    uint32
+	pending map[uint32]reorderMsg
+}
+
+type reorderMsg struct {
+	msg []byte
+	at  time.Time
+}
+
+var reorders = struct {
+	sync.Mutex
+	m map[[4]byte]*reorderBuffer
+}{m: map[[4]byte]*reorderBuffer{}}
+
+// reordered contains sequenced messages in order, they are queued under
+// lock of reorder buffer and written by reorderThread only, so messages
+// released later can't overtake earlier ones
+var reordered = make(chan fecRecoveredMsg, 1024)
+
+func getReorderBuffer(key [4]byte) *reorderBuffer {
+	reorders.Lock()
+	defer reorders.Unlock()
+
+	r, ok := reorders.m[key]
+	if !ok {
+		r = &reorderBuffer{pending: map[uint32]reorderMsg{}}
+		reorders.m[key] = r
+	}
+	return r
+}
+
+// push adds message with sequence seq, returns messages which can be
+// processed in order (with this one)
+func (r *reorderBuffer) push(seq uint32, msg []byte, now time.Time) [][]byte {
+	msg = append([]byte{}, msg...)
+	if !r.started {
+		r.started = true
+		r.next = seq + 1
+		return [][]byte{msg}
+	}
+
+	d := int32(seq - r.next)
+	switch {
+	case 0 == d:
+		r.next++
+		return append([][]byte{msg}, r.drain()...)
+	case d < 0 && d > -reorderWindow:
+		atomic.AddUint64(&seqStats.duplicates, 1)
+		return nil
+	case d > 0 && d < reorderWindow:
+		if _, ok := r.pending[seq]; ok {
+			atomic.AddUint64(&seqStats.duplicates, 1)
+			return nil
+		}
+		atomic.AddUint64(&seqStats.reordered, 1)
+		r.pending[seq] = reorderMsg{msg: msg, at: now}
+		return nil
+	}
+
+	// far from expected (remote restarted or too many lost)
+	ready := r.flush()
+	r.next = seq + 1
+	return append(ready, msg)
+}
+
+// drain returns pending messages following expected one
+func (r *reorderBuffer) drain() [][]byte {
+	var ready [][]byte
+	for {
+		m, ok := r.pending[r.next]
+		if !ok {
+			return ready
+		}
+		delete(r.pending, r.next)
+		ready = append(ready, m.msg)
+		r.next++
+	}
+}
+
+// skip moves expected sequence to first pending message
+func (r *reorderBuffer) skip() {
+	first := true
+	var min int32
+	for seq := range r.pending {
+		if d := int32(seq - r.next); first || d < min {
+			min, first = d, false
+		}
+	}
+	if !first && min > 0 {
+		atomic.AddUint64(&seqStats.lost, uint64(min))
+		r.next += uint32(min)
+	}
+}
+
+// flush returns all pending messages in order
+func (r *reorderBuffer) flush() [][]byte {
+	var ready [][]byte
+	for 0 != len(r.pending) {
+		r.skip()
+		ready = append(ready, r.drain()...)
+	}
+	return ready
+}
+
+// expire returns pending messages which waited for missing ones too long
+// (with messages following them)
+func (r *reorderBuffer) expire(now time.Time) [][]byte {
+	var ready [][]byte
+	for 0 != len(r.pending) {
+		oldest := now
+		for _, m := range r.pending {
+			if m.at.Before(oldest) {
+				oldest = m.at
+			}
+		}
+		if now.Sub(oldest) < reorderTimeout {
+			break
+		}
+		r.skip()
+		ready = append(ready, r.drain()...)
+	}
+	return ready
+}
+
+// seqUnwrap removes sequence header and queues message (with messages
+// released by it) for reorderThread, duplicates are dropped; order is
+// restored per remote identified by LocIP in header
+func seqUnwrap(c *VPNState, from net.Addr, msg []byte, size int) {
+	hdr := msgHeaderLen + seqHeaderLen
+	if size <= hdr {
+		log.Println(eSeqInvalid)
+		return
+	}
+	var key [4]byte
+	copy(key[:], msg[msgHeaderLen:])
+	addr, ok := c.remotes[key]
+	if !ok {
+		log.Println(eSeqInvalid, "from", from)
+		return
+	}
+
+	r := getReorderBuffer(key)
+	r.Lock()
+	r.from = addr
+	r.queue(r.push(binary.BigEndian.Uint32(msg[msgHeaderLen+4:]), msg[hdr:size], time.Now()))
+	r.Unlock()
+}
+
+// queue passes messages to reorderThread, r must be locked
+func (r *reorderBuffer) queue(ready [][]byte) {
+	for _, m := range ready {
+		select {
+		case reordered <- fecRecoveredMsg{from: r.from, msg: m}:
+		default:
+			log.Println("Reordered messages queue is full")
+		}
+	}
+}
+
+// reorderThread writes sequenced messages to local interface and releases
+// messages which wait for missing ones too long
+func reorderThread(iface tunIface) {
+	buf := make([]byte, BUFFERSIZE)
+	ticker := time.NewTicker(reorderTimeout / 4)
+	for {
+		select {
+		case r := <-reordered:
+			conf := config.Load().(VPNState)
+			copy(buf, r.msg)
+			if data, ok := unwrapMsg(&conf, r.from, buf, (*IPPacket)(&r.msg).GetSize()); ok {
+				writeIface(iface, data)
+				flushIface(iface)
+			}
+		case now := <-ticker.C:
+			reorders.Lock()
+			buffers := make([]*reorderBuffer, 0, len(reorders.m))
+			for _, r := range reorders.m {
+				buffers = append(buffers, r)
+			}
+			reorders.Unlock()
+
+			for _, r := range buffers {
+				r.Lock()
+				r.queue(r.expire(now))
+				r.Unlock()
+			}
+		}
+	}
+}
+
+// pathProbeThread sends probes by all paths of multipath remotes
+func pathProbeThread() {
+	payload := make([]byte, 12)
+	for range time.Tick(pathProbeInterval) {
+		c := config.Load().(VPNState)
+		for addr, p := range c.peers {
+			if len(p.paths) < 2 {
+				continue
+			}
+			for _, path := range p.paths {
+				binary.BigEndian.PutUint32(payload, path.state.id)
+				binary.BigEndian.PutUint64(payload[4:], uint64(time.Now().UnixNano()))
+				ctrl.SendPath(&c, ctrlPathProbe, payload, addr, path)
+			}
+		}
+	}
+}
+
+// handlePathProbe answers probe with same payload
+func handlePathProbe(c *VPNState, from [4]byte, payload []byte) {
+	if addr, ok := c.extRemotes[from]; ok && nil != ctrl {
+		ctrl.Send(c, ctrlPathReply, payload, []*net.UDPAddr{addr})
+	}
+}
+
+// handlePathReply marks probed path as alive
+func handlePathReply(c *VPNState, from [4]byte, payload []byte) {
+	if len(payload) < 12 {
+		return
+	}
+	id := binary.BigEndian.Uint32(payload)
+	sent := int64(binary.BigEndian.Uint64(payload[4:]))
+
+	pathRegistry.Lock()
+	var s *pathState
+	if int(id) < len(pathRegistry.byID) {
+		s = pathRegistry.byID[id]
+	}
+	pathRegistry.Unlock()
+
+	if nil != s {
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&s.lastReply, now)
+		atomic.StoreInt64(&s.rtt, now-sent)
+	}
+}
+
+func multipathStatistics() string {
+	pathRegistry.Lock()
+	states := append([]*pathState{}, pathRegistry.byID...)
+	pathRegistry.Unlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].name < states[j].name })
+
+	now := time.Now().UnixNano()
+	var b strings.Builder
+	for _, s := range states {
+		status := "dead"
+		if s.alive(now) {
+			status = fmt.Sprintf("alive rtt %s", time.Duration(atomic.LoadInt64(&s.rtt)))
+		}
+		fmt.Fprintf(&b, "%s %s, %d sent; ", s.name, status, atomic.LoadUint64(&s.sent))
+	}
+	fmt.Fprintf(&b, "%d reordered, %d duplicates, %d lost",
+		atomic.LoadUint64(&seqStats.reordered),
+		atomic.LoadUint64(&seqStats.duplicates),
+		atomic.LoadUint64(&seqStats.lost))
+	return b.String()
+}
+
+func init() {
+	registeredControls[ctrlPathProbe] = handlePathProbe
+	registeredControls[ctrlPathReply] = handlePathReply
+	registeredStats["multipath"] = multipathStatistics
+}
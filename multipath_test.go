@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		seqs   []uint32
+		ready  [][]uint32
+		expire []uint32
+	}{
+		{
+			name:  "in order",
+			seqs:  []uint32{10, 11, 12},
+			ready: [][]uint32{{10}, {11}, {12}},
+		},
+		{
+			name:  "swapped",
+			seqs:  []uint32{10, 12, 11, 13},
+			ready: [][]uint32{{10}, nil, {11, 12}, {13}},
+		},
+		{
+			name:  "duplicates",
+			seqs:  []uint32{10, 10, 12, 12, 11},
+			ready: [][]uint32{{10}, nil, nil, nil, {11, 12}},
+		},
+		{
+			name:   "lost",
+			seqs:   []uint32{10, 12, 13},
+			ready:  [][]uint32{{10}, nil, nil},
+			expire: []uint32{12, 13},
+		},
+		{
+			name:  "wraparound",
+			seqs:  []uint32{0xffffffff, 1, 0},
+			ready: [][]uint32{{0xffffffff}, nil, {0, 1}},
+		},
+		{
+			name:  "restart",
+			seqs:  []uint32{10, 12, 5000},
+			ready: [][]uint32{{10}, nil, {12, 5000}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reorderBuffer{pending: map[uint32]reorderMsg{}}
+			start := time.Now()
+			for i, seq := range tt.seqs {
+				checkReady(t, r.push(seq, []byte{byte(seq)}, start), tt.ready[i])
+			}
+			checkReady(t, r.expire(start.Add(reorderTimeout)), tt.expire)
+		})
+	}
+}
+
+func checkReady(t *testing.T, ready [][]byte, want []uint32) {
+	t.Helper()
+	if len(ready) != len(want) {
+		t.Fatalf("%d messages ready, want %d", len(ready), len(want))
+	}
+	for i, m := range ready {
+		if m[0] != byte(want[i]) {
+			t.Fatalf("message %d is %d, want %d", i, m[0], byte(want[i]))
+		}
+	}
+}
+
+func TestSelectPaths(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 23456}
+	paths, err := parsePaths(addr, []string{"198.51.100.1 3"}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(paths) {
+		t.Fatalf("%d paths, want 2", len(paths))
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		alive []bool
+		want  []int // number of datagrams sent by each path of 4
+	}{
+		{name: "failover", mode: "", alive: []bool{true, true}, want: []int{4, 0}},
+		{name: "failover dead", mode: multipathFailover, alive: []bool{false, true}, want: []int{0, 4}},
+		{name: "all dead", mode: multipathFailover, alive: []bool{false, false}, want: []int{4, 0}},
+		{name: "roundrobin", mode: multipathRoundRobin, alive: []bool{true, true}, want: []int{1, 3}},
+		{name: "roundrobin dead", mode: multipathRoundRobin, alive: []bool{true, false}, want: []int{4, 0}},
+		{name: "redundant", mode: multipathRedundant, alive: []bool{true, true}, want: []int{4, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, alive := range tt.alive {
+				paths[i].state.lastReply = 0
+				if alive {
+					paths[i].state.lastReply = time.Now().UnixNano()
+				}
+			}
+			p := &peerInfo{paths: paths, multipath: tt.mode}
+			got := make([]int, len(paths))
+			for i := 0; i < 4; i++ {
+				for _, path := range p.selectPaths() {
+					for j := range paths {
+						if path.state == paths[j].state {
+							got[j]++
+						}
+					}
+				}
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("sent by paths %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	if _, err := parsePaths(addr, []string{"198.51.100.1 0"}, nil); nil == err {
+		t.Error("zero weight accepted")
+	}
+}
+
+func TestSeqUnwrapByRemote(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 23456}
+
+	var sender VPNState
+	sender.Main.locIP = [4]byte{192, 168, 3, 7}
+	var receiver VPNState
+	receiver.remotes = map[[4]byte]*net.UDPAddr{sender.Main.locIP: peer}
+
+	msg := make([]byte, 64)
+	putMsgHeader(msg, msgIPv4, 20)
+	size := seqWrap(&sender, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}, msg, 20)
+	if msgSeq != msgType(msg) || 20+msgHeaderLen+seqHeaderLen != size {
+		t.Fatalf("wrapped to type %d size %d", msgType(msg), size)
+	}
+
+	// bind address of remote which isn't its path
+	from := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 23456}
+	seqUnwrap(&receiver, from, msg, size)
+	select {
+	case r := <-reordered:
+		if r.from != peer || 20 != len(r.msg) || msgIPv4 != msgType(r.msg) {
+			t.Fatalf("queued %d bytes of type %d from %v", len(r.msg), msgType(r.msg), r.from)
+		}
+	default:
+		t.Fatal("message not queued")
+	}
+
+	unknown := make([]byte, 64)
+	putMsgHeader(unknown, msgIPv4, 20)
+	sender.Main.locIP = [4]byte{192, 168, 3, 99}
+	size = seqWrap(&sender, peer, unknown, 20)
+	seqUnwrap(&receiver, from, unknown, size)
+	if 0 != len(reordered) {
+		t.Error("message of unknown remote queued")
+	}
+}
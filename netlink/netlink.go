@@ -19,8 +19,21 @@ var (
 // A Route is a subnet associated with the interface to reach it.
 type Route struct {
 	*net.IPNet
-	Iface   *net.Interface
-	Default bool
+	Iface    *net.Interface
+	Default  bool
+	Table    int
+	Protocol int
+	Metric   int
+	Src      net.IP
+}
+
+// RouteOptions are optional attributes of added or deleted route, zero
+// Table means main table and zero Protocol means boot
+type RouteOptions struct {
+	Metric   int
+	Table    int
+	Protocol int
+	Replace  bool
 }
 
 // An IfAddr defines IP network settings for a given network interface
@@ -310,6 +310,52 @@ func getNetlinkSocket() (*NetlinkSocket, error) {
 	return s, nil
 }
 
+// rtmgrpIPv4Route is multicast group of IPv4 route changes
+const rtmgrpIPv4Route = 0x40
+
+// RouteMonitor receives notifications about changes of IPv4 routes
+type RouteMonitor struct {
+	s *NetlinkSocket
+}
+
+// NewRouteMonitor returns socket subscribed to IPv4 route changes
+func NewRouteMonitor() (*RouteMonitor, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	s := &NetlinkSocket{
+		fd: fd,
+	}
+	s.lsa.Family = syscall.AF_NETLINK
+	s.lsa.Groups = rtmgrpIPv4Route
+	if err := syscall.Bind(fd, &s.lsa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &RouteMonitor{s: s}, nil
+}
+
+// Wait blocks until some route is added or removed
+func (m *RouteMonitor) Wait() error {
+	for {
+		msgs, err := m.s.Receive()
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type == syscall.RTM_NEWROUTE || msg.Header.Type == syscall.RTM_DELROUTE {
+				return nil
+			}
+		}
+	}
+}
+
+// Close closes monitor socket
+func (m *RouteMonitor) Close() {
+	m.s.Close()
+}
+
 func (s *NetlinkSocket) Close() {
 	syscall.Close(s.fd)
 }
@@ -927,9 +973,17 @@ func NetworkLinkAddIp(iface *net.Interface, ip net.IP, ipNet *net.IPNet) error {
 	)
 }
 
-// Returns an array of IPNet for all the currently routed subnets on ipv4
-// This is similar to the first column of "ip route" output
+// NetworkGetRoutes returns IPv4 routes of main table
 func NetworkGetRoutes() ([]Route, error) {
+	return networkGetRoutes(syscall.RT_TABLE_MAIN)
+}
+
+// NetworkGetAllRoutes returns IPv4 routes of all tables
+func NetworkGetAllRoutes() ([]Route, error) {
+	return networkGetRoutes(syscall.RT_TABLE_UNSPEC)
+}
+
+func networkGetRoutes(table int) ([]Route, error) {
 	s, err := getNetlinkSocket()
 	if err != nil {
 		return nil, err
@@ -978,16 +1032,14 @@ outer:
 				continue
 			}
 
-			if msg.Table != syscall.RT_TABLE_MAIN {
-				// Ignore non-main tables
-				continue
-			}
-
 			if msg.Family != syscall.AF_INET {
 				// Ignore non-ipv4 routes
 				continue
 			}
 
+			r.Table = int(msg.Table)
+			r.Protocol = int(msg.Protocol)
+
 			if msg.Dst_len == 0 {
 				// Default routes
 				r.Default = true
@@ -1008,8 +1060,20 @@ outer:
 				case syscall.RTA_OIF:
 					index := int(native.Uint32(attr.Value[0:4]))
 					r.Iface, _ = net.InterfaceByIndex(index)
+				case syscall.RTA_TABLE:
+					// tables above 255 are only in attribute
+					r.Table = int(native.Uint32(attr.Value[0:4]))
+				case syscall.RTA_PRIORITY:
+					r.Metric = int(native.Uint32(attr.Value[0:4]))
+				case syscall.RTA_PREFSRC:
+					r.Src = net.IP(attr.Value)
 				}
 			}
+
+			if syscall.RT_TABLE_UNSPEC != table && r.Table != table {
+				// Ignore other tables
+				continue
+			}
 			if r.Default || r.IPNet != nil {
 				res = append(res, r)
 			}
@@ -1021,6 +1085,32 @@ outer:
 
 // Add a new route table entry.
 func AddRoute(destination, source, gateway, device string) error {
+	return AddRouteOpts(destination, source, gateway, device, RouteOptions{})
+}
+
+// AddRouteOpts adds route table entry with optional metric and table,
+// existing entry is replaced if opts.Replace is set. Identical to:
+// ip route add|replace $destination via $gateway dev $device src $source metric $metric table $table
+func AddRouteOpts(destination, source, gateway, device string, opts RouteOptions) error {
+	flags := syscall.NLM_F_CREATE | syscall.NLM_F_EXCL | syscall.NLM_F_ACK
+	if opts.Replace {
+		flags = syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE | syscall.NLM_F_ACK
+	}
+	return routeAction(syscall.RTM_NEWROUTE, flags, destination, source, gateway, device, opts)
+}
+
+// Delete route table entry.
+func DelRoute(destination, source, gateway, device string) error {
+	return DelRouteOpts(destination, source, gateway, device, RouteOptions{})
+}
+
+// DelRouteOpts deletes route table entry from given table (and with given
+// metric if it's set)
+func DelRouteOpts(destination, source, gateway, device string, opts RouteOptions) error {
+	return routeAction(syscall.RTM_DELROUTE, syscall.NLM_F_ACK, destination, source, gateway, device, opts)
+}
+
+func routeAction(action, flags int, destination, source, gateway, device string, opts RouteOptions) error {
 	if destination == "" && source == "" && gateway == "" {
 		return fmt.Errorf("one of destination, source or gateway must not be blank")
 	}
@@ -1031,7 +1121,7 @@ func AddRoute(destination, source, gateway, device string) error {
 	}
 	defer s.Close()
 
-	wb := newNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	wb := newNetlinkRequest(action, flags)
 	msg := newRtMsg()
 	currentFamily := -1
 	var rtAttrs []*RtAttr
@@ -1097,99 +1187,22 @@ func AddRoute(destination, source, gateway, device string) error {
 		rtAttrs = append(rtAttrs, newRtAttr(syscall.RTA_GATEWAY, gwData))
 	}
 
-	wb.AddData(msg)
-	for _, attr := range rtAttrs {
-		wb.AddData(attr)
-	}
-
-	iface, err := net.InterfaceByName(device)
-	if err != nil {
-		return err
-	}
-	wb.AddData(uint32Attr(syscall.RTA_OIF, uint32(iface.Index)))
-
-	if err := s.Send(wb); err != nil {
-		return err
-	}
-	return s.HandleAck(wb.Seq)
-}
-
-// Delete route table entry.
-func DelRoute(destination, source, gateway, device string) error {
-	if destination == "" && source == "" && gateway == "" {
-		return fmt.Errorf("one of destination, source or gateway must not be blank")
-	}
-
-	s, err := getNetlinkSocket()
-	if err != nil {
-		return err
-	}
-	defer s.Close()
-
-	wb := newNetlinkRequest(syscall.RTM_DELROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
-	msg := newRtMsg()
-	currentFamily := -1
-	var rtAttrs []*RtAttr
-
-	if destination != "" {
-		destIP, destNet, err := net.ParseCIDR(destination)
-		if err != nil {
-			return fmt.Errorf("destination CIDR %s couldn't be parsed", destination)
-		}
-		destFamily := getIpFamily(destIP)
-		currentFamily = destFamily
-		destLen, bits := destNet.Mask.Size()
-		if destLen == 0 && bits == 0 {
-			return fmt.Errorf("destination CIDR %s generated a non-canonical Mask", destination)
-		}
-		msg.Family = uint8(destFamily)
-		msg.Dst_len = uint8(destLen)
-		var destData []byte
-		if destFamily == syscall.AF_INET {
-			destData = destIP.To4()
+	if opts.Table != 0 {
+		// tables above 255 are only in attribute
+		if opts.Table < 256 {
+			msg.Table = uint8(opts.Table)
 		} else {
-			destData = destIP.To16()
+			msg.Table = syscall.RT_TABLE_UNSPEC
 		}
-		rtAttrs = append(rtAttrs, newRtAttr(syscall.RTA_DST, destData))
+		rtAttrs = append(rtAttrs, uint32Attr(syscall.RTA_TABLE, uint32(opts.Table)))
 	}
 
-	if source != "" {
-		srcIP := net.ParseIP(source)
-		if srcIP == nil {
-			return fmt.Errorf("source IP %s couldn't be parsed", source)
-		}
-		srcFamily := getIpFamily(srcIP)
-		if currentFamily != -1 && currentFamily != srcFamily {
-			return fmt.Errorf("source and destination ip were not the same IP family")
-		}
-		currentFamily = srcFamily
-		msg.Family = uint8(srcFamily)
-		var srcData []byte
-		if srcFamily == syscall.AF_INET {
-			srcData = srcIP.To4()
-		} else {
-			srcData = srcIP.To16()
-		}
-		rtAttrs = append(rtAttrs, newRtAttr(syscall.RTA_PREFSRC, srcData))
+	if opts.Protocol != 0 {
+		msg.Protocol = uint8(opts.Protocol)
 	}
 
-	if gateway != "" {
-		gwIP := net.ParseIP(gateway)
-		if gwIP == nil {
-			return fmt.Errorf("gateway IP %s couldn't be parsed", gateway)
-		}
-		gwFamily := getIpFamily(gwIP)
-		if currentFamily != -1 && currentFamily != gwFamily {
-			return fmt.Errorf("gateway, source, and destination ip were not the same IP family")
-		}
-		msg.Family = uint8(gwFamily)
-		var gwData []byte
-		if gwFamily == syscall.AF_INET {
-			gwData = gwIP.To4()
-		} else {
-			gwData = gwIP.To16()
-		}
-		rtAttrs = append(rtAttrs, newRtAttr(syscall.RTA_GATEWAY, gwData))
+	if opts.Metric != 0 {
+		rtAttrs = append(rtAttrs, uint32Attr(syscall.RTA_PRIORITY, uint32(opts.Metric)))
 	}
 
 	wb.AddData(msg)
@@ -15,6 +15,23 @@ func NetworkGetRoutes() ([]Route, error) {
 	return nil, ErrNotImplemented
 }
 
+func NetworkGetAllRoutes() ([]Route, error) {
+	return nil, ErrNotImplemented
+}
+
+type RouteMonitor struct{}
+
+func NewRouteMonitor() (*RouteMonitor, error) {
+	return nil, ErrNotImplemented
+}
+
+func (m *RouteMonitor) Wait() error {
+	return ErrNotImplemented
+}
+
+func (m *RouteMonitor) Close() {
+}
+
 func NetworkLinkAdd(name string, linkType string) error {
 	return ErrNotImplemented
 }
@@ -39,6 +56,14 @@ func AddRoute(destination, source, gateway, device string) error {
 	return ErrNotImplemented
 }
 
+func AddRouteOpts(destination, source, gateway, device string, opts RouteOptions) error {
+	return ErrNotImplemented
+}
+
+func DelRouteOpts(destination, source, gateway, device string, opts RouteOptions) error {
+	return ErrNotImplemented
+}
+
 func AddDefaultGw(ip, device string) error {
 	return ErrNotImplemented
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Padding hides size of inner packets: message is padded (before encryption)
+// to next bucket size or by random number of bytes, receiver uses size from
+// message header so padding is ignored by it.
+//
+// Obfuscation hides structure of encrypted datagram (IV, block aligned size):
+// datagram is prefixed with random nonce and length, followed by random
+// number of junk bytes and everything after nonce is XORed with AES-CTR
+// keystream of key derived from main.obfuscateKey, nonce from crypto/rand is
+// used as IV (its last 4 bytes are block counter):
+//
+//	nonce(12) | length(2) | datagram | junk(0..15)
+
+const (
+	obfsNonceLen  = 12
+	obfsHeaderLen = obfsNonceLen + 2
+	obfsMaxJunk   = 16
+
+	// maxPaddedSize is size of largest message (full frame in tap mode)
+	maxPaddedSize = MTU + ethHeaderLen + msgHeaderLen
+)
+
+var defaultPaddingBuckets = []int{128, 256, 512, 1024, maxPaddedSize}
+
+// paddingPolicy is either list of bucket sizes or max random padding
+type paddingPolicy struct {
+	buckets []int
+	random  int
+}
+
+// parsePadding parses "buckets", "buckets:128,512,1300" or "random:64"
+func parsePadding(s string) (paddingPolicy, error) {
+	name, args, _ := strings.Cut(strings.ToLower(strings.TrimSpace(s)), ":")
+	switch name {
+	case "", "none":
+		return paddingPolicy{}, nil
+	case "buckets":
+		if "" == args {
+			return paddingPolicy{buckets: defaultPaddingBuckets}, nil
+		}
+		var p paddingPolicy
+		for _, b := range strings.Split(args, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(b))
+			if nil != err {
+				return paddingPolicy{}, err
+			}
+			if size < 1 || size > maxPaddedSize {
+				return paddingPolicy{}, errors.New("bucket size must be between 1 and " +
+					strconv.Itoa(maxPaddedSize))
+			}
+			p.buckets = append(p.buckets, size)
+		}
+		sort.Ints(p.buckets)
+		return p, nil
+	case "random":
+		max, err := strconv.Atoi(strings.TrimSpace(args))
+		if nil != err {
+			return paddingPolicy{}, err
+		}
+		if max < 1 || max > maxPaddedSize {
+			return paddingPolicy{}, errors.New("random padding must be between 1 and " +
+				strconv.Itoa(maxPaddedSize))
+		}
+		return paddingPolicy{random: max}, nil
+	}
+	return paddingPolicy{}, errors.New("must be buckets[:sizes] or random:max")
+}
+
+func (p paddingPolicy) enabled() bool {
+	return 0 != len(p.buckets) || 0 != p.random
+}
+
+// size returns padded size of message with size plen
+func (p paddingPolicy) size(plen int) int {
+	size := plen
+	if 0 != p.random {
+		size += rand.Intn(p.random + 1)
+	}
+	for _, b := range p.buckets {
+		if b >= plen {
+			size = b
+			break
+		}
+	}
+	if size > maxPaddedSize && plen <= maxPaddedSize {
+		size = maxPaddedSize
+	}
+	return size
+}
+
+// paddingFor returns padding policy for dsts, padding of first remote
+// requesting it is used for messages sent to multiple remotes
+func (c *VPNState) paddingFor(dsts []*net.UDPAddr) paddingPolicy {
+	for _, addr := range dsts {
+		if p, ok := c.peers[addr]; ok && p.padding.enabled() {
+			return p.padding
+		}
+	}
+	return paddingPolicy{}
+}
+
+// padMsg pads message with zeroes according to policy and returns new size
+func padMsg(p paddingPolicy, packet []byte, plen int) int {
+	size := p.size(plen)
+	if size <= plen || size > len(packet) {
+		return plen
+	}
+	clear(packet[plen:size])
+	return size
+}
+
+// newObfuscator returns block cipher used for obfuscation keystream
+func newObfuscator(key string) (cipher.Block, error) {
+	if "" == key {
+		return nil, errors.New("main.obfuscateKey is required for obfuscation")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return aes.NewCipher(sum[:])
+}
+
+func obfsStream(block cipher.Block, nonce []byte) cipher.Stream {
+	var iv [aes.BlockSize]byte
+	copy(iv[:], nonce)
+	return cipher.NewCTR(block, iv[:])
+}
+
+var obfsBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, BUFFERSIZE+obfsHeaderLen+obfsMaxJunk)
+		return &b
+	},
+}
+
+// obfuscate wraps datagram into dst and returns its size
+func obfuscate(block cipher.Block, data []byte, dst []byte) int {
+	size := obfsHeaderLen + len(data) + rand.Intn(obfsMaxJunk)
+	if size > len(dst) || len(data) > 0xffff {
+		return 0
+	}
+	if _, err := io.ReadFull(crand.Reader, dst[:obfsNonceLen]); nil != err {
+		return 0
+	}
+	binary.BigEndian.PutUint16(dst[obfsNonceLen:], uint16(len(data)))
+	copy(dst[obfsHeaderLen:], data)
+	clear(dst[obfsHeaderLen+len(data) : size])
+	obfsStream(block, dst[:obfsNonceLen]).XORKeyStream(dst[obfsNonceLen:size], dst[obfsNonceLen:size])
+	return size
+}
+
+// deobfuscate unwraps datagram in place
+func deobfuscate(block cipher.Block, data []byte) ([]byte, bool) {
+	if len(data) < obfsHeaderLen {
+		return nil, false
+	}
+	obfsStream(block, data[:obfsNonceLen]).XORKeyStream(data[obfsNonceLen:], data[obfsNonceLen:])
+	size := int(binary.BigEndian.Uint16(data[obfsNonceLen:]))
+	if obfsHeaderLen+size > len(data) {
+		return nil, false
+	}
+	return data[obfsHeaderLen : obfsHeaderLen+size], true
+}
+
+// obfuscatedFrom returns true if datagrams from sender are obfuscated
+func (c *VPNState) obfuscatedFrom(from net.Addr) bool {
+	key, ok := extKey(from)
+	if !ok {
+		return false
+	}
+	addr, ok := c.extRemotes[key]
+	if !ok {
+		return false
+	}
+	p, ok := c.peers[addr]
+	return ok && p.obfuscate
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddingPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		plen    int
+		min     int
+		max     int
+		wantErr bool
+	}{
+		{name: "none", policy: "", plen: 100, min: 100, max: 100},
+		{name: "default buckets", policy: "buckets", plen: 100, min: 128, max: 128},
+		{name: "custom buckets", policy: "buckets:1000, 300", plen: 301, min: 1000, max: 1000},
+		{name: "above buckets", policy: "buckets:300", plen: 400, min: 400, max: 400},
+		{name: "random", policy: "random:64", plen: 100, min: 100, max: 164},
+		{name: "random capped", policy: "random:64", plen: maxPaddedSize - 1, min: maxPaddedSize - 1, max: maxPaddedSize},
+		{name: "invalid bucket", policy: "buckets:0", wantErr: true},
+		{name: "invalid random", policy: "random", wantErr: true},
+		{name: "unknown", policy: "fixed:100", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parsePadding(tt.policy)
+			if (nil != err) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			for i := 0; i < 100; i++ {
+				if size := p.size(tt.plen); size < tt.min || size > tt.max {
+					t.Fatalf("size(%d) = %d, want %d..%d", tt.plen, size, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestObfuscate(t *testing.T) {
+	block, err := newObfuscator("secret")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{16, 100, 1400} {
+		data := bytes.Repeat([]byte{0x42}, size)
+		buf := make([]byte, BUFFERSIZE+obfsHeaderLen+obfsMaxJunk)
+		n := obfuscate(block, data, buf)
+		if n < size+obfsHeaderLen || n >= size+obfsHeaderLen+obfsMaxJunk {
+			t.Fatalf("obfuscated size %d for %d bytes", n, size)
+		}
+		if bytes.Contains(buf[:n], data[:16]) {
+			t.Fatalf("datagram is visible in obfuscated data")
+		}
+
+		out, ok := deobfuscate(block, buf[:n])
+		if !ok || !bytes.Equal(out, data) {
+			t.Fatalf("deobfuscated data differs for %d bytes", size)
+		}
+	}
+
+	// each datagram has own nonce, so keystream is never reused
+	a := make([]byte, BUFFERSIZE+obfsHeaderLen+obfsMaxJunk)
+	b := make([]byte, BUFFERSIZE+obfsHeaderLen+obfsMaxJunk)
+	obfuscate(block, []byte("data"), a)
+	obfuscate(block, []byte("data"), b)
+	if bytes.Equal(a[:obfsNonceLen], b[:obfsNonceLen]) {
+		t.Error("nonce reused")
+	}
+
+	if _, err := newObfuscator(""); nil == err {
+		t.Error("empty key accepted")
+	}
+}
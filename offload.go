@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"sync"
+)
+
+// TUN with IFF_VNET_HDR prepends struct virtio_net_hdr to each packet,
+// which allows kernel to pass large TCP segments (TSO) to us and
+// us to pass coalesced segments (GRO) back to kernel
+
+const (
+	// virtioNetHdrLen is size of struct virtio_net_hdr
+	virtioNetHdrLen = 10
+
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+
+	// offloadBufSize is maximum size of packet with virtio header
+	offloadBufSize = virtioNetHdrLen + 65535
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+var (
+	eOffloadShort   = errors.New("Packet too small for virtio header")
+	eOffloadGSOType = errors.New("Unsupported GSO type")
+	eOffloadNoSpace = errors.New("No space left for segments")
+)
+
+// virtioNetHdr is struct virtio_net_hdr, kernel uses native (little on all
+// supported platforms) endian for it
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:])
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// checksumAdd adds b to not folded ones' complement sum
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if 1 == len(b) {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds sum to 16 bits
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum returns not folded sum of IPv4 pseudo header
+func pseudoHeaderSum(ip []byte, proto byte, length int) uint32 {
+	return checksumAdd(0, ip[12:20]) + uint32(proto) + uint32(length)
+}
+
+// ipv4HeaderChecksum recalculates checksum of IPv4 header
+func ipv4HeaderChecksum(ip []byte, ihl int) {
+	ip[10], ip[11] = 0, 0
+	binary.BigEndian.PutUint16(ip[10:], ^checksumFold(checksumAdd(0, ip[:ihl])))
+}
+
+// gsoSplit converts packet with virtio header into list of ordinary
+// IP packets, segments are stored in out buffer and appended to segs
+func gsoSplit(pkt []byte, out []byte, segs [][]byte) ([][]byte, error) {
+	if len(pkt) < virtioNetHdrLen {
+		return segs, eOffloadShort
+	}
+
+	var h virtioNetHdr
+	h.decode(pkt)
+	data := pkt[virtioNetHdrLen:]
+
+	if virtioNetHdrGSONone != h.gsoType && virtioNetHdrGSOTCPv4 != h.gsoType {
+		return segs, eOffloadGSOType
+	}
+
+	if virtioNetHdrGSONone == h.gsoType {
+		if 0 != h.flags&virtioNetHdrFNeedsCsum {
+			// csum field contains pseudo header sum, we need to add the rest
+			start := int(h.csumStart)
+			field := start + int(h.csumOffset)
+			if field+2 > len(data) {
+				return segs, ePacketSmall
+			}
+			sum := ^checksumFold(checksumAdd(0, data[start:]))
+			binary.BigEndian.PutUint16(data[field:], sum)
+		}
+		return append(segs, data), nil
+	}
+
+	if len(data) < 40 || 6 != data[9] {
+		return segs, ePacketSmall
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 || len(data) < ihl+20 {
+		return segs, ePacketSmall
+	}
+	hdrs := ihl + int(data[ihl+12]>>4)*4
+	mss := int(h.gsoSize)
+	if hdrs > len(data) || 0 == mss {
+		return segs, ePacketInvalidSize
+	}
+
+	payload := data[hdrs:]
+	id := binary.BigEndian.Uint16(data[4:])
+	seq := binary.BigEndian.Uint32(data[ihl+4:])
+	flags := data[ihl+13]
+
+	for off := 0; off < len(payload); off += mss {
+		end := off + mss
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		segLen := hdrs + end - off
+		if segLen > len(out) {
+			return segs, eOffloadNoSpace
+		}
+		seg := out[:segLen]
+		out = out[segLen:]
+
+		copy(seg, data[:hdrs])
+		copy(seg[hdrs:], payload[off:end])
+
+		binary.BigEndian.PutUint16(seg[2:], uint16(segLen))
+		binary.BigEndian.PutUint16(seg[4:], id)
+		id++
+		ipv4HeaderChecksum(seg, ihl)
+
+		tcp := seg[ihl:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(off))
+		if end != len(payload) {
+			// FIN and PSH only for last segment
+			tcp[13] = flags &^ (tcpFlagFIN | tcpFlagPSH)
+		}
+		if 0 != off {
+			tcp[13] &^= tcpFlagCWR
+		}
+		tcp[16], tcp[17] = 0, 0
+		sum := checksumAdd(pseudoHeaderSum(seg, 6, len(tcp)), tcp)
+		binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(sum))
+
+		segs = append(segs, seg)
+	}
+
+	return segs, nil
+}
+
+// groTCP coalesces consecutive TCP segments of one flow into single
+// packet with virtio GSO header
+type groTCP struct {
+	buf     []byte // virtio header + coalesced packet
+	n       int    // used bytes of buf
+	segs    int
+	segSize int
+	hdrLen  int
+	nextSeq uint32
+	closed  bool // last segment was smaller or had PSH
+}
+
+// start begins new coalesced packet, returns false if p can't be coalesced
+func (g *groTCP) start(p []byte) bool {
+	if len(p) < 40 || 0x45 != p[0] || 6 != p[9] ||
+		0 != (int(p[6]&0x3f)<<8|int(p[7])) {
+		// only TCP without IP options and fragmentation
+		return false
+	}
+	size := int(binary.BigEndian.Uint16(p[2:]))
+	doff := int(p[32] >> 4)
+	hdrLen := 20 + doff*4
+	flags := p[33]
+	// data offset below 5 is invalid and would break header comparison
+	if doff < 5 || size > len(p) || hdrLen >= size || size+virtioNetHdrLen > len(g.buf) ||
+		0 != flags&^(tcpFlagACK|tcpFlagPSH) || 0 == flags&tcpFlagACK {
+		return false
+	}
+
+	copy(g.buf[virtioNetHdrLen:], p[:size])
+	g.n = virtioNetHdrLen + size
+	g.segs = 1
+	g.segSize = size - hdrLen
+	g.hdrLen = hdrLen
+	g.nextSeq = binary.BigEndian.Uint32(p[24:]) + uint32(g.segSize)
+	g.closed = 0 != flags&tcpFlagPSH
+	return true
+}
+
+// append adds p to coalesced packet if it's next segment of same flow
+func (g *groTCP) append(p []byte) bool {
+	if 0 == g.segs || g.closed || len(p) < g.hdrLen {
+		return false
+	}
+	ip := g.buf[virtioNetHdrLen:g.n]
+	size := int(binary.BigEndian.Uint16(p[2:]))
+	payload := size - g.hdrLen
+	flags := p[33]
+
+	// same IP header (except length, id and checksum), same TCP header
+	// (except seq, flags and checksum)
+	if size > len(p) || payload <= 0 || payload > g.segSize ||
+		g.n+payload > len(g.buf) ||
+		0x45 != p[0] || string(ip[:2]) != string(p[:2]) ||
+		string(ip[6:10]) != string(p[6:10]) ||
+		string(ip[12:20]) != string(p[12:20]) ||
+		g.hdrLen != 20+int(p[32]>>4)*4 ||
+		string(ip[20:24]) != string(p[20:24]) ||
+		string(ip[28:33]) != string(p[28:33]) ||
+		string(ip[34:36]) != string(p[34:36]) ||
+		string(ip[38:g.hdrLen]) != string(p[38:g.hdrLen]) ||
+		0 != flags&^(tcpFlagACK|tcpFlagPSH) ||
+		g.nextSeq != binary.BigEndian.Uint32(p[24:]) {
+		return false
+	}
+
+	copy(g.buf[g.n:], p[g.hdrLen:size])
+	g.n += payload
+	g.segs++
+	g.nextSeq += uint32(payload)
+	if 0 != flags&tcpFlagPSH {
+		g.buf[virtioNetHdrLen+33] |= tcpFlagPSH
+		g.closed = true
+	}
+	if payload < g.segSize {
+		g.closed = true
+	}
+	return true
+}
+
+// packet returns coalesced packet with virtio header and resets state
+func (g *groTCP) packet() []byte {
+	var h virtioNetHdr
+	ip := g.buf[virtioNetHdrLen:g.n]
+
+	if g.segs > 1 {
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+		ipv4HeaderChecksum(ip, 20)
+		// kernel completes checksum, so only pseudo header sum is stored
+		binary.BigEndian.PutUint16(ip[36:],
+			checksumFold(pseudoHeaderSum(ip, 6, len(ip)-20)))
+
+		h.flags = virtioNetHdrFNeedsCsum
+		h.gsoType = virtioNetHdrGSOTCPv4
+		h.hdrLen = uint16(g.hdrLen)
+		h.gsoSize = uint16(g.segSize)
+		h.csumStart = 20
+		h.csumOffset = 16
+	}
+	h.encode(g.buf)
+
+	result := g.buf[:g.n]
+	g.segs = 0
+	g.n = 0
+	return result
+}
+
+// vnetTun is TUN device opened with IFF_VNET_HDR and TSO enabled,
+// Read returns already segmented packets, Write coalesces TCP segments
+// until Flush
+type vnetTun struct {
+	f    *os.File
+	name string
+
+	rmu  sync.Mutex
+	rbuf []byte
+	sbuf []byte
+	segs [][]byte
+	next int
+
+	wmu  sync.Mutex
+	wbuf []byte
+	gro  groTCP
+}
+
+func newVnetTun(f *os.File, name string) *vnetTun {
+	return &vnetTun{
+		f:    f,
+		name: name,
+		rbuf: make([]byte, offloadBufSize),
+		sbuf: make([]byte, 2*offloadBufSize),
+		wbuf: make([]byte, BUFFERSIZE+virtioNetHdrLen),
+		gro:  groTCP{buf: make([]byte, offloadBufSize)},
+	}
+}
+
+func (t *vnetTun) Name() string {
+	return t.name
+}
+
+func (t *vnetTun) Close() error {
+	return t.f.Close()
+}
+
+func (t *vnetTun) Read(b []byte) (int, error) {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+
+	for t.next >= len(t.segs) {
+		n, err := t.f.Read(t.rbuf)
+		if nil != err {
+			return 0, err
+		}
+		t.next = 0
+		t.segs, err = gsoSplit(t.rbuf[:n], t.sbuf, t.segs[:0])
+		if nil != err {
+			log.Println("Unable to segment packet from interface:", err)
+			t.segs = t.segs[:0]
+		}
+	}
+
+	n := copy(b, t.segs[t.next])
+	t.next++
+	return n, nil
+}
+
+func (t *vnetTun) Write(b []byte) (int, error) {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	if t.gro.append(b) {
+		return len(b), nil
+	}
+	if err := t.flushLocked(); nil != err {
+		return 0, err
+	}
+	if t.gro.start(b) {
+		return len(b), nil
+	}
+
+	// not TCP or so, just write with empty header
+	if len(b)+virtioNetHdrLen > len(t.wbuf) {
+		return 0, ePacketInvalidSize
+	}
+	var h virtioNetHdr
+	h.encode(t.wbuf)
+	copy(t.wbuf[virtioNetHdrLen:], b)
+	n, err := t.f.Write(t.wbuf[:virtioNetHdrLen+len(b)])
+	if nil != err {
+		return 0, err
+	}
+	return n - virtioNetHdrLen, nil
+}
+
+// Flush writes pending coalesced segments to device
+func (t *vnetTun) Flush() error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	return t.flushLocked()
+}
+
+func (t *vnetTun) flushLocked() error {
+	if 0 == t.gro.segs {
+		return nil
+	}
+	_, err := t.f.Write(t.gro.packet())
+	return err
+}
@@ -0,0 +1,59 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	iffMultiQueue = 0x0100
+
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+)
+
+type tunIfReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	pad   [0x28 - syscall.IFNAMSIZ - 2]byte
+}
+
+func tunIoctl(fd int, request uintptr, argp uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, argp)
+	if 0 != errno {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// openVnetTun opens (new or next queue of existing) TUN device
+// with virtio header and checksum/TSO offloads enabled
+func openVnetTun(name string, multiQueue bool) (*vnetTun, error) {
+	fd, err := syscall.Open("/dev/net/tun", os.O_RDWR|syscall.O_CLOEXEC, 0)
+	if nil != err {
+		return nil, err
+	}
+
+	var req tunIfReq
+	copy(req.Name[:], name)
+	req.Flags = syscall.IFF_TUN | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR
+	if multiQueue {
+		req.Flags |= iffMultiQueue
+	}
+
+	err = tunIoctl(fd, syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
+	if nil == err {
+		err = tunIoctl(fd, syscall.TUNSETOFFLOAD, tunFCsum|tunFTSO4)
+	}
+	if nil != err {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return newVnetTun(os.NewFile(uintptr(fd), "tun"),
+		strings.TrimRight(string(req.Name[:]), "\x00")), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testTSOPacket returns TCP packet with virtio header and given payload size
+func testTSOPacket(payload int, mss uint16) []byte {
+	p := make([]byte, virtioNetHdrLen+40+payload)
+	h := virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    virtioNetHdrGSOTCPv4,
+		hdrLen:     40,
+		gsoSize:    mss,
+		csumStart:  20,
+		csumOffset: 16,
+	}
+	h.encode(p)
+
+	ip := p[virtioNetHdrLen:]
+	copy(ip, []byte{
+		0x45, 0x00, 0x00, 0x00, 0x10, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		0xc0, 0xa8, 0x03, 0x0f, 0xc0, 0xa8, 0x03, 0x03,
+		0x9c, 0x40, 0x00, 0x50, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x50, tcpFlagACK | tcpFlagPSH, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00,
+	})
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+	for i := 40; i < len(ip); i++ {
+		ip[i] = byte(i)
+	}
+	return p
+}
+
+func testValidChecksums(t *testing.T, seg []byte) {
+	if 0 != ^checksumFold(checksumAdd(0, seg[:20])) {
+		t.Error("invalid IP checksum")
+	}
+	if 0 != ^checksumFold(checksumAdd(pseudoHeaderSum(seg, 6, len(seg)-20), seg[20:])) {
+		t.Error("invalid TCP checksum")
+	}
+}
+
+func TestGsoSplit(t *testing.T) {
+	pkt := testTSOPacket(3000, 1260)
+	segs, err := gsoSplit(pkt, make([]byte, 2*offloadBufSize), nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 3 != len(segs) {
+		t.Fatalf("got %d segments, want 3", len(segs))
+	}
+
+	var payload []byte
+	for i, seg := range segs {
+		testValidChecksums(t, seg)
+		if got := int(binary.BigEndian.Uint16(seg[2:])); got != len(seg) {
+			t.Errorf("segment %d length = %d, want %d", i, got, len(seg))
+		}
+		if got, want := binary.BigEndian.Uint32(seg[24:]), uint32(0x1000+1260*i); got != want {
+			t.Errorf("segment %d seq = %#x, want %#x", i, got, want)
+		}
+		if psh := 0 != seg[33]&tcpFlagPSH; psh != (i == len(segs)-1) {
+			t.Errorf("segment %d PSH = %v", i, psh)
+		}
+		payload = append(payload, seg[40:]...)
+	}
+	if !bytes.Equal(payload, pkt[virtioNetHdrLen+40:]) {
+		t.Error("payload mismatch after segmentation")
+	}
+}
+
+func TestGroTCP(t *testing.T) {
+	pkt := testTSOPacket(3000, 1260)
+	segs, err := gsoSplit(append([]byte{}, pkt...), make([]byte, 2*offloadBufSize), nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	g := groTCP{buf: make([]byte, offloadBufSize)}
+	if !g.start(segs[0]) {
+		t.Fatal("first segment not accepted")
+	}
+	for i, seg := range segs[1:] {
+		if !g.append(seg) {
+			t.Fatalf("segment %d not coalesced", i+1)
+		}
+	}
+	if g.append(segs[0]) {
+		t.Error("out of order segment coalesced")
+	}
+
+	result := g.packet()
+	var h virtioNetHdr
+	h.decode(result)
+	if virtioNetHdrGSOTCPv4 != h.gsoType || 1260 != h.gsoSize || 40 != h.hdrLen {
+		t.Errorf("unexpected virtio header %+v", h)
+	}
+	ip := result[virtioNetHdrLen:]
+	if !bytes.Equal(ip[40:], pkt[virtioNetHdrLen+40:]) {
+		t.Error("payload mismatch after coalescing")
+	}
+	if 0 == ip[33]&tcpFlagPSH {
+		t.Error("PSH flag lost")
+	}
+	if 0 != ^checksumFold(checksumAdd(0, ip[:20])) {
+		t.Error("invalid IP checksum")
+	}
+	if 0 != g.segs {
+		t.Error("state not reset")
+	}
+}
+
+func TestGroTCPInvalidOffset(t *testing.T) {
+	pkt := testTSOPacket(3000, 1260)
+	segs, err := gsoSplit(append([]byte{}, pkt...), make([]byte, 2*offloadBufSize), nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	g := groTCP{buf: make([]byte, offloadBufSize)}
+	for doff := byte(0); doff < 5; doff++ {
+		bad := append([]byte{}, segs[0]...)
+		bad[32] = doff<<4 | bad[32]&0x0f
+		if g.start(bad) {
+			t.Errorf("segment with data offset %d accepted", doff)
+		}
+	}
+
+	if !g.start(segs[0]) {
+		t.Fatal("first segment not accepted")
+	}
+	bad := append([]byte{}, segs[1]...)
+	bad[32] = 0x10 | bad[32]&0x0f
+	if g.append(bad) {
+		t.Error("segment with invalid data offset coalesced")
+	}
+}
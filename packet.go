@@ -43,3 +43,70 @@ func (p *IPPacket) Src() [4]byte {
 func (p *IPPacket) IsMulticast() bool {
 	return ((*p)[16] > 223) && ((*p)[16] < 240)
 }
+
+// ClampMSS lowers MSS option of TCP SYN packet to mss (if it's bigger)
+// and fixes TCP checksum, returns true if packet was modified
+func (p *IPPacket) ClampMSS(mss uint16) bool {
+	pkt := *p
+	if len(pkt) < 20 {
+		return false
+	}
+
+	ihl := int(pkt[0]&0x0f) * 4
+	// TCP only, and only not fragmented (or first fragment) packets
+	if 6 != pkt[9] || ihl < 20 || 0 != (int(pkt[6]&0x1f)<<8|int(pkt[7])) {
+		return false
+	}
+
+	size := p.GetSize()
+	if size > len(pkt) {
+		size = len(pkt)
+	}
+	tcp := pkt[ihl:size]
+	if len(tcp) < 20 || 0 == tcp[13]&0x02 {
+		// not SYN
+		return false
+	}
+
+	dataOff := int(tcp[12]>>4) * 4
+	if dataOff < 20 || dataOff > len(tcp) {
+		return false
+	}
+
+	opts := tcp[20:dataOff]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0: // end of options
+			return false
+		case 1: // nop
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return false
+		}
+		if 2 == opts[i] && 4 == opts[i+1] {
+			old := uint16(opts[i+2])<<8 | uint16(opts[i+3])
+			if old <= mss {
+				return false
+			}
+			opts[i+2] = byte(mss >> 8)
+			opts[i+3] = byte(mss)
+
+			// incremental checksum update (RFC 1624)
+			sum := ^(uint32(tcp[16])<<8 | uint32(tcp[17])) & 0xffff
+			sum += uint32(^old) & 0xffff
+			sum += uint32(mss)
+			for sum > 0xffff {
+				sum = (sum & 0xffff) + (sum >> 16)
+			}
+			sum = ^sum & 0xffff
+			tcp[16] = byte(sum >> 8)
+			tcp[17] = byte(sum)
+			return true
+		}
+		i += int(opts[i+1])
+	}
+
+	return false
+}
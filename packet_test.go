@@ -181,3 +181,84 @@ func TestIPPacket_GetSize(t *testing.T) {
 		})
 	}
 }
+
+func testTCPSyn(mss uint16) IPPacket {
+	p := IPPacket([]byte{
+		// IPv4 header, 192.168.3.15 -> 192.168.3.3, TCP
+		0x45, 0x00, 0x00, 0x2c, 0x00, 0x01, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		0xc0, 0xa8, 0x03, 0x0f, 0xc0, 0xa8, 0x03, 0x03,
+		// TCP header, 40000 -> 80, SYN, data offset 6 (one option)
+		0x9c, 0x40, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x60, 0x02, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00,
+		// MSS option
+		0x02, 0x04, byte(mss >> 8), byte(mss),
+	})
+	sum := testTCPChecksum(p)
+	p[36] = byte(sum >> 8)
+	p[37] = byte(sum)
+	return p
+}
+
+// testTCPChecksum calculates full TCP checksum with zeroed checksum field
+func testTCPChecksum(p IPPacket) uint16 {
+	tcp := append([]byte{}, p[20:]...)
+	tcp[16], tcp[17] = 0, 0
+	buf := append([]byte{}, p[12:20]...)
+	buf = append(buf, 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+	buf = append(buf, tcp...)
+	var sum uint32
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint32(buf[i])<<8 | uint32(buf[i+1])
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func TestIPPacket_ClampMSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       IPPacket
+		mss     uint16
+		want    bool
+		wantMSS uint16
+	}{
+		{
+			name:    "clamped",
+			p:       testTCPSyn(1460),
+			mss:     1260,
+			want:    true,
+			wantMSS: 1260,
+		},
+		{
+			name:    "already small",
+			p:       testTCPSyn(1200),
+			mss:     1260,
+			want:    false,
+			wantMSS: 1200,
+		},
+		{
+			name: "ping",
+			p:    append(IPPacket{}, testICMPPing...),
+			mss:  1260,
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.ClampMSS(tt.mss); got != tt.want {
+				t.Errorf("IPPacket.ClampMSS() = %v, want %v", got, tt.want)
+			}
+			if 6 != tt.p[9] {
+				return
+			}
+			if got := uint16(tt.p[42])<<8 | uint16(tt.p[43]); got != tt.wantMSS {
+				t.Errorf("MSS = %v, want %v", got, tt.wantMSS)
+			}
+			if got, want := uint16(tt.p[36])<<8|uint16(tt.p[37]), testTCPChecksum(tt.p); got != want {
+				t.Errorf("checksum = %#04x, want %#04x", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// packetHeadroom is space reserved before packet data for IV
+	packetHeadroom = 64
+
+	// packetTailroom is space reserved after packet data for padding and MAC
+	packetTailroom = 64
+
+	// pipelineQueueLen is capacity of queue between pipeline stages
+	pipelineQueueLen = 64
+)
+
+// packetBuf holds one packet with headroom and tailroom,
+// so encryption can be done in place without copying
+type packetBuf struct {
+	buf []byte
+	off int // start of data
+	n   int // length of data
+
+	// filled by classify stage
+	dsts []*net.UDPAddr
+	// message is already wrapped (FEC parity), it's only encrypted
+	wrapped bool
+
+	// remote address of received datagram
+	from net.Addr
+}
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &packetBuf{
+			buf: make([]byte, packetHeadroom+BUFFERSIZE+packetTailroom),
+		}
+	},
+}
+
+// getPacketBuf returns empty buffer from pool
+func getPacketBuf() *packetBuf {
+	b := packetPool.Get().(*packetBuf)
+	b.off = packetHeadroom
+	b.n = 0
+	b.dsts = nil
+	b.wrapped = false
+	b.from = nil
+	return b
+}
+
+// Release returns buffer to pool, it can't be used after
+func (b *packetBuf) Release() {
+	packetPool.Put(b)
+}
+
+// Data returns packet data, capacity includes tailroom
+func (b *packetBuf) Data() []byte {
+	return b.buf[b.off : b.off+b.n]
+}
+
+// Room returns space for packet data (without headroom and tailroom)
+func (b *packetBuf) Room() []byte {
+	return b.buf[b.off : b.off+BUFFERSIZE]
+}
+
+// sndrPipeline runs sender as chain of stages connected by bounded queues:
+// read from interface -> classify and encrypt in place -> send
+func sndrPipeline(conn *net.UDPConn, iface tunIface, stop *atomic.Bool) {
+	// first time fill with random numbers
+	ivbuf := make([]byte, config.Load().(VPNState).Main.main.IVLen())
+	if _, err := io.ReadFull(rand.Reader, ivbuf); err != nil {
+		log.Fatalln("Unable to get rand data:", err)
+	}
+
+	encrypt := make(chan *packetBuf, pipelineQueueLen)
+	send := make(chan *packetBuf, pipelineQueueLen)
+
+	go func() {
+		for b := range encrypt {
+			// each time get pointer to (probably) new config
+			c := config.Load().(VPNState)
+
+			// IV is written to headroom just before data
+			ivLen := c.Main.main.IVLen()
+			var size int
+			size, b.dsts = prepareOutgoing(&c, b.Data(), b.buf[b.off-ivLen:], ivbuf)
+			if 0 == len(b.dsts) {
+				b.Release()
+				continue
+			}
+			b.off -= ivLen
+			b.n = size
+			send <- b
+		}
+		close(send)
+	}()
+
+	go func() {
+		for b := range send {
+			c := config.Load().(VPNState)
+			data := b.Data()
+			for _, addr := range b.dsts {
+				n, err := c.sendTo(conn, data, addr)
+				if nil != err {
+					log.Println("Error sending package:", err)
+				}
+				if n != len(data) {
+					log.Println("Only ", n, " bytes of ", len(data), " sent")
+				}
+			}
+			b.Release()
+		}
+	}()
+
+	tap := isTAP(iface)
+
+	for {
+		b := getPacketBuf()
+		n, err := readIface(iface, b.Room(), tap)
+		if err != nil {
+			b.Release()
+			break
+		}
+		b.n = n
+		encrypt <- b
+		if stop.Load() {
+			break
+		}
+	}
+	close(encrypt)
+}
+
+// rcvrPipeline runs receiver as chain of stages connected by bounded queues:
+// read from socket -> decrypt -> write to interface
+func rcvrPipeline(conn net.PacketConn, iface tunIface) {
+	decrypt := make(chan *packetBuf, pipelineQueueLen)
+	write := make(chan *packetBuf, pipelineQueueLen)
+
+	go func() {
+		for b := range decrypt {
+			conf := config.Load().(VPNState)
+			out := getPacketBuf()
+			data, ok := decryptIncoming(&conf, b.from, b.Data(), out.Room())
+			b.Release()
+			if !ok {
+				out.Release()
+				continue
+			}
+			// data is part of out buffer (without message header)
+			out.off += cap(out.Room()) - cap(data)
+			out.n = len(data)
+			write <- out
+		}
+		close(write)
+	}()
+
+	go func() {
+		for b := range write {
+			writeIface(iface, b.Data())
+			b.Release()
+			// coalesced segments are written when queue is empty
+			if 0 == len(write) {
+				flushIface(iface)
+			}
+		}
+	}()
+
+	for {
+		b := getPacketBuf()
+		n, from, err := conn.ReadFrom(b.Room())
+		if err != nil {
+			b.Release()
+			if errors.Is(err, net.ErrClosed) {
+				close(decrypt)
+				return
+			}
+			log.Println("Error: ", err)
+			continue
+		}
+		if 0 == n {
+			b.Release()
+			continue
+		}
+		b.n = n
+		b.from = from
+		decrypt <- b
+	}
+}
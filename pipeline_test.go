@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketBuf_InPlaceEncrypt(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  string
+		key  string
+	}{
+		{
+			name: "none",
+			enc:  "none",
+		},
+		{
+			name: "aescbc",
+			enc:  "aescbc",
+			key:  "4A34E352D7C32FC42F1CEB0CAA54D40E",
+		},
+		{
+			name: "aescbchmac",
+			enc:  "aescbchmac",
+			key:  "4A34E352D7C32FC42F1CEB0CAA54D40E9D1EEDAF14EBCBCECA429E1B2EF72D214A34E352D7C32FC42F1CEB0CAA54D40E",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := registeredEncrypters[tt.enc](tt.key)
+			if nil != err {
+				t.Fatal(err)
+			}
+			iv := make([]byte, e.IVLen())
+			ivCopy := make([]byte, e.IVLen())
+
+			b := getPacketBuf()
+			defer b.Release()
+			b.n = copy(b.Room(), testICMPPing)
+			clen := e.AdjustInputSize(b.n)
+
+			expected := make([]byte, BUFFERSIZE)
+			esize := e.Encrypt(append([]byte{}, b.buf[b.off:b.off+clen]...), expected, ivCopy)
+
+			ivLen := e.IVLen()
+			size := e.Encrypt(b.buf[b.off:b.off+clen], b.buf[b.off-ivLen:], iv)
+			b.off -= ivLen
+			b.n = size
+
+			if !bytes.Equal(b.Data(), expected[:esize]) {
+				t.Error("in place encryption differs from copying one")
+			}
+
+			decrypted := make([]byte, BUFFERSIZE)
+			dsize, err := DecryptMsgChk(e, b.Data(), decrypted)
+			if nil != err {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted[:dsize], testICMPPing) {
+				t.Error("decrypted packet differs")
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With QoS packets read from local interface are queued per remote by
+// priority class (from DSCP/ToS of IP header), each remote has own sender
+// which takes packets with higher priority first and limits rate by token
+// bucket. Packets for multiple remotes (broadcast, multicast, flooded
+// frames) have own queue without rate limit.
+
+const (
+	qosHigh = iota
+	qosNormal
+	qosBulk
+	qosClasses
+)
+
+const (
+	// qosQueueLen is capacity of each class queue, packets are dropped
+	// when it's full
+	qosQueueLen = 256
+
+	// qosBurst is amount of traffic (in time at limited rate) which can
+	// be sent at once
+	qosBurst = 50 * time.Millisecond
+
+	// ipTOSLowDelay is old style ToS bit used by interactive applications
+	ipTOSLowDelay = 0x10
+)
+
+var qosClassNames = [qosClasses]string{"high", "normal", "bulk"}
+
+// qosClass returns priority class for DSCP/ToS byte of IP header
+func qosClass(tos byte) int {
+	dscp := tos >> 2
+	switch {
+	case dscp >= 32: // CS4-CS7, AF4x, EF (VoIP)
+		return qosHigh
+	case dscp >= 18 && dscp <= 22 && 0 == dscp%2: // AF2x (interactive ssh)
+		return qosHigh
+	case 0 != tos&ipTOSLowDelay && 0 == tos&^(ipTOSLowDelay|3):
+		return qosHigh
+	case 8 == dscp || 1 == dscp: // CS1, LE
+		return qosBulk
+	}
+	return qosNormal
+}
+
+// packetTOS returns ToS of IPv4 packet or of IPv4 packet in ethernet message
+func packetTOS(packet []byte) byte {
+	switch msgType(packet) {
+	case msgIPv4:
+		return packet[1]
+	case msgEthernet:
+		frame := packet[msgHeaderLen:]
+		if len(frame) > ethHeaderLen+1 && 0x08 == frame[12] && 0x00 == frame[13] {
+			return frame[ethHeaderLen+1]
+		}
+	}
+	return 0
+}
+
+// parseRate parses rate like "20mbit", "512kbit" or "1000000" (bits per
+// second) and returns it in bytes per second (0 means no limit)
+func parseRate(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if "" == s {
+		return 0, nil
+	}
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"gbit", 1000000000}, {"mbit", 1000000}, {"kbit", 1000}, {"bit", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if nil != err {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, errors.New("rate must be positive")
+	}
+	return n * mult / 8, nil
+}
+
+// tokenBucket limits rate of sent bytes
+type tokenBucket struct {
+	rate   int64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// take consumes n bytes from bucket, returns time to wait before
+// trying again if there are not enough tokens
+func (t *tokenBucket) take(n int, now time.Time) time.Duration {
+	if t.rate <= 0 {
+		return 0
+	}
+
+	burst := float64(t.rate) * qosBurst.Seconds()
+	if burst < BUFFERSIZE {
+		burst = BUFFERSIZE
+	}
+	if t.last.IsZero() {
+		t.tokens = burst
+	} else {
+		t.tokens += float64(t.rate) * now.Sub(t.last).Seconds()
+		if t.tokens > burst {
+			t.tokens = burst
+		}
+	}
+	t.last = now
+
+	if t.tokens >= float64(n) {
+		t.tokens -= float64(n)
+		return 0
+	}
+	return time.Duration((float64(n) - t.tokens) / float64(t.rate) * float64(time.Second))
+}
+
+var qosStats struct {
+	sent      [qosClasses]uint64
+	dropped   [qosClasses]uint64
+	throttled uint64
+}
+
+// qosQueue contains packets for one remote (or for multiple remotes)
+type qosQueue struct {
+	key     [4]byte
+	classes [qosClasses]chan *packetBuf
+}
+
+var qosQueues = struct {
+	sync.Mutex
+	m map[[4]byte]*qosQueue
+}{m: map[[4]byte]*qosQueue{}}
+
+// getQoSQueue returns queue for remote with external address key
+// (zero key for packets to multiple remotes), sender is started for new one
+func getQoSQueue(key [4]byte, conn *net.UDPConn) *qosQueue {
+	qosQueues.Lock()
+	defer qosQueues.Unlock()
+
+	q, ok := qosQueues.m[key]
+	if !ok {
+		q = &qosQueue{key: key}
+		for i := range q.classes {
+			q.classes[i] = make(chan *packetBuf, qosQueueLen)
+		}
+		qosQueues.m[key] = q
+		go q.sender(conn)
+	}
+	return q
+}
+
+// push adds packet to queue of its class, returns false if queue is full
+func (q *qosQueue) push(b *packetBuf, class int) bool {
+	select {
+	case q.classes[class] <- b:
+		return true
+	default:
+		atomic.AddUint64(&qosStats.dropped[class], 1)
+		return false
+	}
+}
+
+// next returns packet of highest class available (waits for it)
+func (q *qosQueue) next() (*packetBuf, int) {
+	for class, ch := range q.classes {
+		select {
+		case b := <-ch:
+			return b, class
+		default:
+		}
+	}
+	select {
+	case b := <-q.classes[qosHigh]:
+		return b, qosHigh
+	case b := <-q.classes[qosNormal]:
+		return b, qosNormal
+	case b := <-q.classes[qosBulk]:
+		return b, qosBulk
+	}
+}
+
+// sender encrypts and sends queued packets respecting rate limit of remote
+func (q *qosQueue) sender(conn *net.UDPConn) {
+	ivbuf := make([]byte, config.Load().(VPNState).Main.main.IVLen())
+	if _, err := io.ReadFull(rand.Reader, ivbuf); err != nil {
+		log.Fatalln("Unable to get rand data:", err)
+	}
+
+	var bucket tokenBucket
+
+	for {
+		b, class := q.next()
+
+		c := config.Load().(VPNState)
+		dsts := b.dsts
+		bucket.rate = 0
+		if addr, ok := c.extRemotes[q.key]; ok {
+			dsts = []*net.UDPAddr{addr}
+			bucket.rate = c.peers[addr].rateLimit
+		}
+
+		// IV is written to headroom just before data
+		ivLen := c.Main.main.IVLen()
+		var size int
+		if b.wrapped {
+			size = encryptOutgoing(&c, b.buf[b.off:], b.n, b.buf[b.off-ivLen:], ivbuf)
+		} else {
+			size = sealOutgoing(&c, dsts, b.Data(), b.buf[b.off-ivLen:], ivbuf)
+		}
+		if 0 == size {
+			b.Release()
+			continue
+		}
+		data := b.buf[b.off-ivLen : b.off-ivLen+size]
+
+		if wait := bucket.take(size, time.Now()); wait > 0 {
+			atomic.AddUint64(&qosStats.throttled, 1)
+			for ; wait > 0; wait = bucket.take(size, time.Now()) {
+				time.Sleep(wait)
+			}
+		}
+
+		for _, addr := range dsts {
+			if _, err := c.sendTo(conn, data, addr); nil != err {
+				log.Println("Error sending package:", err)
+			}
+		}
+		atomic.AddUint64(&qosStats.sent[class], 1)
+		b.Release()
+	}
+}
+
+// queueMsg queues already wrapped message (FEC parity) to sender of remote
+// addr, returns false if it's dropped
+func queueMsg(conn *net.UDPConn, addr *net.UDPAddr, msg []byte, class int) bool {
+	key, ok := extKey(addr)
+	if !ok {
+		return false
+	}
+	b := getPacketBuf()
+	if len(msg) > len(b.Room()) {
+		b.Release()
+		return false
+	}
+	b.n = copy(b.Room(), msg)
+	b.dsts = []*net.UDPAddr{addr}
+	b.wrapped = true
+	if !getQoSQueue(key, conn).push(b, class) {
+		b.Release()
+		return false
+	}
+	return true
+}
+
+// sndrQoS reads packets from local interface and queues them to
+// senders of remotes
+func sndrQoS(conn *net.UDPConn, iface tunIface, stop *atomic.Bool) {
+	tap := isTAP(iface)
+
+	for {
+		b := getPacketBuf()
+		n, err := readIface(iface, b.Room(), tap)
+		if err != nil {
+			b.Release()
+			break
+		}
+		b.n = n
+
+		c := config.Load().(VPNState)
+		b.dsts = c.outgoingDsts(b.Data())
+		if 0 == len(b.dsts) {
+			b.Release()
+			continue
+		}
+
+		var key [4]byte
+		if 1 == len(b.dsts) {
+			key, _ = extKey(b.dsts[0])
+		}
+		if !getQoSQueue(key, conn).push(b, qosClass(packetTOS(b.Data()))) {
+			c.captureOutgoing(b.dsts, b.Data(), "queue full")
+			b.Release()
+		}
+		if stop.Load() {
+			return
+		}
+	}
+}
+
+func qosStatistics() string {
+	var s []string
+	for i, name := range qosClassNames {
+		s = append(s, fmt.Sprintf("%s %d sent %d dropped", name,
+			atomic.LoadUint64(&qosStats.sent[i]), atomic.LoadUint64(&qosStats.dropped[i])))
+	}
+	return fmt.Sprintf("%s, %d throttled", strings.Join(s, ", "),
+		atomic.LoadUint64(&qosStats.throttled))
+}
+
+func init() {
+	registeredStats["qos"] = qosStatistics
+}
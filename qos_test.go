@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQoSClass(t *testing.T) {
+	tests := []struct {
+		name string
+		tos  byte
+		want int
+	}{
+		{name: "default", tos: 0, want: qosNormal},
+		{name: "EF", tos: 46 << 2, want: qosHigh},
+		{name: "CS6", tos: 48 << 2, want: qosHigh},
+		{name: "AF21", tos: 18 << 2, want: qosHigh},
+		{name: "low delay", tos: ipTOSLowDelay, want: qosHigh},
+		{name: "CS1", tos: 8 << 2, want: qosBulk},
+		{name: "LE", tos: 1 << 2, want: qosBulk},
+		{name: "AF11", tos: 10 << 2, want: qosNormal},
+		{name: "ECN", tos: 3, want: qosNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := qosClass(tt.tos); got != tt.want {
+				t.Errorf("qosClass(%#x) = %s, want %s", tt.tos, qosClassNames[got], qosClassNames[tt.want])
+			}
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    int64
+		wantErr bool
+	}{
+		{rate: "", want: 0},
+		{rate: "8000", want: 1000},
+		{rate: "512kbit", want: 64000},
+		{rate: "20 Mbit", want: 2500000},
+		{rate: "1gbit", want: 125000000},
+		{rate: "0", wantErr: true},
+		{rate: "fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rate, func(t *testing.T) {
+			got, err := parseRate(tt.rate)
+			if (nil != err) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseRate(%q) = %d, want %d", tt.rate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := tokenBucket{rate: 100000} // burst is 5000 bytes
+	now := time.Now()
+
+	sent := 0
+	for 0 == b.take(1000, now) {
+		sent += 1000
+	}
+	if 5000 != sent {
+		t.Fatalf("burst of %d bytes, want 5000", sent)
+	}
+
+	if wait := b.take(1000, now); wait != 10*time.Millisecond {
+		t.Fatalf("wait %s, want 10ms", wait)
+	}
+	if wait := b.take(1000, now.Add(10*time.Millisecond)); 0 != wait {
+		t.Fatalf("wait %s after refill", wait)
+	}
+
+	unlimited := tokenBucket{}
+	if 0 != unlimited.take(1<<20, now) {
+		t.Fatal("unlimited bucket waits")
+	}
+}
+
+func TestQueueMsg(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 23456}
+	key := [4]byte{192, 0, 2, 7}
+
+	// queue without sender
+	q := &qosQueue{key: key}
+	for i := range q.classes {
+		q.classes[i] = make(chan *packetBuf, 1)
+	}
+	qosQueues.Lock()
+	qosQueues.m[key] = q
+	qosQueues.Unlock()
+	defer func() {
+		qosQueues.Lock()
+		delete(qosQueues.m, key)
+		qosQueues.Unlock()
+	}()
+
+	msg := []byte("parity")
+	if !queueMsg(nil, addr, msg, qosNormal) {
+		t.Fatal("message is not queued")
+	}
+	if queueMsg(nil, addr, msg, qosNormal) {
+		t.Fatal("message queued to full queue")
+	}
+
+	b := <-q.classes[qosNormal]
+	defer b.Release()
+	if !b.wrapped || !bytes.Equal(msg, b.Data()) || 1 != len(b.dsts) || addr != b.dsts[0] {
+		t.Errorf("queued %q (wrapped %v) to %v", b.Data(), b.wrapped, b.dsts)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kanocz/lcvpn/netlink"
+)
+
+// With main.exportRoutes host exports kernel routes matching any of
+// selectors (e.g. "proto=bird within=10.0.0.0/8") to all remotes, they are
+// added to routes of exporting remote on reload and so installed by
+// routesThread. Advertised routes which overlap configured ones or overlay
+// network are skipped, advertisements not refreshed expire after controlTTL.
+
+const (
+	// ctrlRoutes is control message with exported routes of sender
+	ctrlRoutes = 5
+
+	// routeChangeDelay collects burst of kernel route changes to one
+	// export or reconciliation
+	routeChangeDelay = 500 * time.Millisecond
+
+	// rtTableMain and rtTableLocal are kernel routing tables
+	rtTableMain  = 254
+	rtTableLocal = 255
+)
+
+// routeProtocols are names of route protocols from /etc/iproute2/rt_protos
+var routeProtocols = map[string]int{
+	"kernel": 2,
+	"boot":   3,
+	"static": 4,
+	"zebra":  11,
+	"bird":   12,
+	"dhcp":   16,
+	"babel":  42,
+	"bgp":    186,
+	"isis":   187,
+	"ospf":   188,
+	"rip":    189,
+	"eigrp":  192,
+}
+
+// routeSelector selects kernel routes for export, table 0 and protocol -1
+// mean any
+type routeSelector struct {
+	table  int
+	proto  int
+	within *net.IPNet
+}
+
+// parseRouteSelector parses space separated table=, proto= and within=
+// conditions, table defaults to main
+func parseRouteSelector(s string) (routeSelector, error) {
+	sel := routeSelector{table: rtTableMain, proto: -1}
+	for _, cond := range strings.Fields(s) {
+		key, value, ok := strings.Cut(cond, "=")
+		if !ok {
+			return sel, fmt.Errorf("condition \"%s\" isn't key=value", cond)
+		}
+		switch key {
+		case "table":
+			switch value {
+			case "main":
+				sel.table = rtTableMain
+			case "all":
+				sel.table = 0
+			default:
+				n, err := strconv.Atoi(value)
+				if nil != err || n <= 0 {
+					return sel, fmt.Errorf("invalid table \"%s\"", value)
+				}
+				sel.table = n
+			}
+		case "proto":
+			if n, ok := routeProtocols[value]; ok {
+				sel.proto = n
+			} else if n, err := strconv.Atoi(value); nil == err && n >= 0 && n < 256 {
+				sel.proto = n
+			} else {
+				return sel, fmt.Errorf("invalid proto \"%s\"", value)
+			}
+		case "within":
+			_, within, err := net.ParseCIDR(value)
+			if nil != err || nil == within.IP.To4() {
+				return sel, fmt.Errorf("invalid network \"%s\"", value)
+			}
+			sel.within = within
+		default:
+			return sel, fmt.Errorf("unknown condition \"%s\"", key)
+		}
+	}
+	return sel, nil
+}
+
+// match returns true if route is selected
+func (sel *routeSelector) match(r *netlink.Route) bool {
+	if 0 != sel.table && r.Table != sel.table {
+		return false
+	}
+	if -1 != sel.proto && r.Protocol != sel.proto {
+		return false
+	}
+	if nil != sel.within {
+		ones, _ := r.IPNet.Mask.Size()
+		wones, _ := sel.within.Mask.Size()
+		if ones < wones || !sel.within.Contains(r.IPNet.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectExported returns sorted routes to export, default routes, routes
+// via own interface and local table are never exported
+func selectExported(routes []netlink.Route, sels []routeSelector, ifaceName string, overlay *net.IPNet) []string {
+	set := map[string]bool{}
+	for i := range routes {
+		r := &routes[i]
+		if r.Default || nil == r.IPNet || nil == r.IPNet.IP.To4() || rtTableLocal == r.Table {
+			continue
+		}
+		if nil != r.Iface && r.Iface.Name == ifaceName {
+			continue
+		}
+		if nil != overlay && netsOverlap(r.IPNet, overlay) {
+			continue
+		}
+		for j := range sels {
+			if sels[j].match(r) {
+				set[r.IPNet.String()] = true
+				break
+			}
+		}
+	}
+	result := make([]string, 0, len(set))
+	for route := range set {
+		result = append(result, route)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// advertisedRoutes are routes advertised by remote
+type advertisedRoutes struct {
+	routes []string
+	seen   time.Time
+}
+
+var routeAdv = struct {
+	sync.Mutex
+	exported   []string
+	advertised map[string]*advertisedRoutes
+	changed    chan struct{}
+}{
+	advertised: map[string]*advertisedRoutes{},
+	changed:    make(chan struct{}, 1),
+}
+
+// setExported stores exported routes, returns true if they are changed
+func setExported(routes []string) bool {
+	routeAdv.Lock()
+	defer routeAdv.Unlock()
+	if reflect.DeepEqual(routeAdv.exported, routes) {
+		return false
+	}
+	routeAdv.exported = routes
+	return true
+}
+
+// packRoutes packs routes as 4 bytes of network and 1 byte of prefix length
+func packRoutes(routes []string) []byte {
+	payload := make([]byte, 0, 5*len(routes))
+	for _, routestr := range routes {
+		if len(payload)+5 > maxControlPayload() {
+			log.Println("Too many exported routes, only", len(payload)/5, "are advertised")
+			break
+		}
+		_, route, err := net.ParseCIDR(routestr)
+		if nil != err || nil == route.IP.To4() {
+			continue
+		}
+		ones, _ := route.Mask.Size()
+		payload = append(payload, route.IP.To4()...)
+		payload = append(payload, byte(ones))
+	}
+	return payload
+}
+
+// unpackRoutes is reverse of packRoutes, invalid entries are skipped
+func unpackRoutes(payload []byte) []string {
+	routes := []string{}
+	for ; len(payload) >= 5; payload = payload[5:] {
+		if payload[4] > 32 {
+			continue
+		}
+		route := net.IPNet{IP: net.IP(payload[:4]), Mask: net.CIDRMask(int(payload[4]), 32)}
+		route.IP = route.IP.Mask(route.Mask)
+		routes = append(routes, route.String())
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// announceRoutes sends exported routes to all remotes, empty list is sent
+// too so remotes remove routes which are not exported anymore
+func announceRoutes(c *VPNState, s *controlSender) {
+	if 0 == len(c.Main.exportRoutes) {
+		return
+	}
+	routeAdv.Lock()
+	payload := packRoutes(routeAdv.exported)
+	routeAdv.Unlock()
+	s.Send(c, ctrlRoutes, payload, c.remoteList)
+}
+
+// handleRoutes stores routes advertised by known remote
+func handleRoutes(c *VPNState, from [4]byte, payload []byte) {
+	addr, ok := c.extRemotes[from]
+	if !ok {
+		return
+	}
+	peer, ok := c.peers[addr]
+	if !ok {
+		return
+	}
+	routes := unpackRoutes(payload)
+
+	routeAdv.Lock()
+	old, ok := routeAdv.advertised[peer.name]
+	changed := !ok || !reflect.DeepEqual(old.routes, routes)
+	routeAdv.advertised[peer.name] = &advertisedRoutes{routes: routes, seen: time.Now()}
+	routeAdv.Unlock()
+
+	if changed {
+		log.Printf("Routes advertised by %s: %s\n", peer.name, strings.Join(routes, ", "))
+		select {
+		case routeAdv.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// expireRoutes removes not refreshed advertisements, returns true if any
+// of them contained routes
+func expireRoutes(now time.Time) bool {
+	routeAdv.Lock()
+	defer routeAdv.Unlock()
+
+	expired := false
+	for name, a := range routeAdv.advertised {
+		if now.Sub(a.seen) >= controlTTL {
+			log.Println("Routes advertised by", name, "expired")
+			delete(routeAdv.advertised, name)
+			expired = expired || 0 != len(a.routes)
+		}
+	}
+	return expired
+}
+
+// advertisedRemoteRoutes adds advertised routes to remotes of c, routes
+// overlapping already defined ones or overlay network are skipped
+func advertisedRemoteRoutes(c *VPNState) {
+	routes, overlay := knownRoutes(c)
+
+	now := time.Now()
+	routeAdv.Lock()
+	defer routeAdv.Unlock()
+
+	names := make([]string, 0, len(routeAdv.advertised))
+	for name := range routeAdv.advertised {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		a := routeAdv.advertised[name]
+		r, ok := c.Remote[name]
+		if !ok || now.Sub(a.seen) >= controlTTL {
+			continue
+		}
+		routes = r.addRoutes(a.routes, routes, overlay)
+	}
+}
+
+// routeAdvThread reloads config when advertised routes are changed
+func routeAdvThread(routeReload chan bool) {
+	ticker := time.NewTicker(controlInterval)
+	for {
+		select {
+		case now := <-ticker.C:
+			if !expireRoutes(now) {
+				continue
+			}
+		case <-routeAdv.changed:
+		}
+		reloadConfig(routeReload, "advertised routes")
+	}
+}
+
+func routeAdvStatistics() string {
+	routeAdv.Lock()
+	defer routeAdv.Unlock()
+	n := 0
+	for _, a := range routeAdv.advertised {
+		n += len(a.routes)
+	}
+	return fmt.Sprintf("%d exported, %d advertised by %d remotes",
+		len(routeAdv.exported), n, len(routeAdv.advertised))
+}
+
+func init() {
+	registeredControls[ctrlRoutes] = handleRoutes
+	registeredAnnouncers[ctrlRoutes] = announceRoutes
+	registeredStats["routes"] = routeAdvStatistics
+}
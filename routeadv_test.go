@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kanocz/lcvpn/netlink"
+)
+
+func TestRouteSelector(t *testing.T) {
+	for _, s := range []string{"proto", "proto=foo", "table=x", "within=10.0.0.0", "metric=1"} {
+		if _, err := parseRouteSelector(s); nil == err {
+			t.Errorf("selector \"%s\" accepted", s)
+		}
+	}
+
+	route := func(cidr string, table, proto int, iface string) netlink.Route {
+		_, n, _ := net.ParseCIDR(cidr)
+		r := netlink.Route{IPNet: n, Table: table, Protocol: proto}
+		if "" != iface {
+			r.Iface = &net.Interface{Name: iface}
+		}
+		return r
+	}
+	routes := []netlink.Route{
+		route("10.1.0.0/16", rtTableMain, 12, "eth0"),
+		route("10.2.0.0/16", rtTableMain, 4, "eth0"),
+		route("10.3.0.0/16", 100, 4, "eth0"),
+		route("172.16.0.0/12", rtTableMain, 12, "eth0"),
+		route("10.0.0.0/8", rtTableMain, 12, "eth0"),
+		route("10.4.0.0/16", rtTableMain, 12, "tun0"),
+		route("192.168.3.0/24", rtTableMain, 12, "eth0"),
+		route("10.5.0.1/32", rtTableLocal, 2, "eth0"),
+		{Default: true, Table: rtTableMain, Protocol: 12},
+	}
+	_, overlay, _ := net.ParseCIDR("192.168.3.1/24")
+
+	for _, test := range []struct {
+		sels []string
+		want []string
+	}{
+		{[]string{"proto=bird within=10.0.0.0/8"}, []string{"10.0.0.0/8", "10.1.0.0/16"}},
+		{[]string{"table=100", "proto=static within=10.2.0.0/16"}, []string{"10.2.0.0/16", "10.3.0.0/16"}},
+		{[]string{"table=all proto=kernel"}, []string{}},
+		{[]string{"proto=12"}, []string{"10.0.0.0/8", "10.1.0.0/16", "172.16.0.0/12"}},
+	} {
+		var sels []routeSelector
+		for _, s := range test.sels {
+			sel, err := parseRouteSelector(s)
+			if nil != err {
+				t.Fatal(err)
+			}
+			sels = append(sels, sel)
+		}
+		if got := selectExported(routes, sels, "tun0", overlay); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.sels, got, test.want)
+		}
+	}
+}
+
+func TestAdvertisedRoutes(t *testing.T) {
+	routes := []string{"10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16", "192.168.0.0/16"}
+	if got := unpackRoutes(packRoutes(routes)); !reflect.DeepEqual(got, routes) {
+		t.Fatalf("unpacked %q", got)
+	}
+
+	routeAdv.advertised = map[string]*advertisedRoutes{}
+	defer func() { routeAdv.advertised = map[string]*advertisedRoutes{} }()
+
+	var c VPNState
+	c.Main.Port = 23456
+	c.Main.NetCIDR = 24
+	c.Remote = map[string]*remoteConfig{
+		"a": {ExtIP: "1.1.1.1", LocIP: "192.168.3.1", Route: []string{"10.1.0.0/16"}},
+		"b": {ExtIP: "2.2.2.2", LocIP: "192.168.3.2"},
+	}
+	peer := &net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 23456}
+	c.extRemotes = map[[4]byte]*net.UDPAddr{{2, 2, 2, 2}: peer}
+	c.peers = map[*net.UDPAddr]*peerInfo{peer: {name: "b"}}
+
+	handleRoutes(&c, [4]byte{2, 2, 2, 2}, packRoutes(routes))
+	handleRoutes(&c, [4]byte{3, 3, 3, 3}, packRoutes(routes))
+	if 1 != len(routeAdv.advertised) {
+		t.Fatalf("advertised by %d remotes", len(routeAdv.advertised))
+	}
+
+	// routes overlapping configured ones or overlay network are skipped
+	advertisedRemoteRoutes(&c)
+	if want := []string{"10.2.0.0/16", "10.3.0.0/16"}; !reflect.DeepEqual(c.Remote["b"].Route, want) {
+		t.Errorf("remote b routes %q, want %q", c.Remote["b"].Route, want)
+	}
+	if problems := checkConfig(&c); 0 != len(problems) {
+		t.Errorf("config with advertised routes is invalid: %q", problems)
+	}
+
+	if !expireRoutes(time.Now().Add(2*controlTTL)) || 0 != len(routeAdv.advertised) {
+		t.Error("advertised routes not expired")
+	}
+}
@@ -0,0 +1,12 @@
+// +build darwin
+
+package main
+
+import "log"
+
+// routeExportThread isn't supported on darwin (no netlink)
+func routeExportThread(ifaceName string) {
+	if c := config.Load().(VPNState); 0 != len(c.Main.exportRoutes) {
+		log.Println("main.exportRoutes isn't supported on this platform")
+	}
+}
@@ -0,0 +1,54 @@
+// +build linux
+
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kanocz/lcvpn/netlink"
+)
+
+// routeExportThread dumps kernel routes on each change reported by netlink
+// (and periodically) and announces exported routes if they are changed
+func routeExportThread(ifaceName string) {
+	changes := monitorRoutes()
+	ticker := time.NewTicker(controlInterval)
+	for {
+		c := config.Load().(VPNState)
+		if 0 != len(c.Main.exportRoutes) {
+			exportRoutes(&c, ifaceName)
+		} else {
+			setExported(nil)
+		}
+
+		select {
+		case <-changes:
+			waitRoutes(changes)
+		case <-ticker.C:
+		}
+	}
+}
+
+// exportRoutes selects kernel routes and announces them if they are changed
+func exportRoutes(c *VPNState, ifaceName string) {
+	routes, err := netlink.NetworkGetAllRoutes()
+	if nil != err {
+		log.Println("Unable to get kernel routes:", err)
+		return
+	}
+	var overlay *net.IPNet
+	if _, n, err := net.ParseCIDR(c.Main.local); nil == err {
+		overlay = n
+	}
+
+	exported := selectExported(routes, c.Main.exportRoutes, ifaceName, overlay)
+	if setExported(exported) {
+		log.Println("Exported routes:", strings.Join(exported, ", "))
+		if nil != ctrl {
+			ctrl.Announce(ctrlRoutes)
+		}
+	}
+}
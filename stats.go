@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// statsFunc returns one line of statistics
+type statsFunc func() string
+
+var registeredStats = make(map[string]statsFunc)
+
+// statsThread logs all registered statistics on USR1 signal
+func statsThread() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	for range c {
+		names := make([]string, 0, len(registeredStats))
+		for name := range registeredStats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			log.Printf("Stats %s: %s\n", name, registeredStats[name]())
+		}
+	}
+}
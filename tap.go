@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// ethHeaderLen is size of ethernet header (without VLAN tag)
+	ethHeaderLen = 14
+
+	// macTableTTL is time after which not refreshed MAC entry is forgotten
+	macTableTTL = 5 * time.Minute
+)
+
+type macEntry struct {
+	addr *net.UDPAddr
+	seen time.Time
+}
+
+// macTable maps MAC addresses of remote hosts to remotes behind which
+// they were seen (tap mode)
+type macTable struct {
+	sync.RWMutex
+	entries map[[6]byte]macEntry
+}
+
+var macs = macTable{entries: map[[6]byte]macEntry{}}
+
+// Learn remembers that mac is reachable via remote addr
+func (t *macTable) Learn(mac []byte, addr *net.UDPAddr) {
+	var key [6]byte
+	copy(key[:], mac)
+	if 0 != key[0]&1 {
+		// group address can't be source
+		return
+	}
+
+	now := time.Now()
+
+	t.RLock()
+	e, ok := t.entries[key]
+	t.RUnlock()
+	// update not more than once per second to avoid lock contention
+	if ok && e.addr == addr && now.Sub(e.seen) < time.Second {
+		return
+	}
+
+	t.Lock()
+	t.entries[key] = macEntry{addr: addr, seen: now}
+	t.Unlock()
+}
+
+// Lookup returns remote for mac or nil if unknown (or expired)
+func (t *macTable) Lookup(mac []byte) *net.UDPAddr {
+	var key [6]byte
+	copy(key[:], mac)
+
+	t.RLock()
+	e, ok := t.entries[key]
+	t.RUnlock()
+
+	if !ok || time.Since(e.seen) > macTableTTL {
+		return nil
+	}
+	return e.addr
+}
+
+// Expire removes old entries
+func (t *macTable) Expire() {
+	t.Lock()
+	for k, e := range t.entries {
+		if time.Since(e.seen) > macTableTTL {
+			delete(t.entries, k)
+		}
+	}
+	t.Unlock()
+}
+
+func macExpireThread() {
+	for range time.Tick(macTableTTL) {
+		macs.Expire()
+	}
+}
+
+// isTAP returns true if local interface works with ethernet frames
+func isTAP(iface tunIface) bool {
+	t, ok := iface.(interface {
+		IsTAP() bool
+	})
+	return ok && t.IsTAP()
+}
+
+// frameDsts returns remotes for ethernet frame, broadcast, multicast and
+// unknown unicast frames are flooded to remotes without noBroadcast
+func (c *VPNState) frameDsts(frame []byte) []*net.UDPAddr {
+	if 0 == frame[0]&1 {
+		if addr := macs.Lookup(frame[0:6]); nil != addr {
+			return []*net.UDPAddr{addr}
+		}
+	}
+	return c.bcastList
+}
+
+// learnFrame remembers source MAC of frame received from remote
+func (c *VPNState) learnFrame(frame []byte, from net.Addr) {
+	key, ok := extKey(from)
+	if !ok {
+		return
+	}
+	if addr, ok := c.extRemotes[key]; ok {
+		macs.Learn(frame[6:12], addr)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestVPNState_frameDsts(t *testing.T) {
+	prague := &net.UDPAddr{IP: net.ParseIP("46.234.105.229"), Port: 23456}
+	berlin := &net.UDPAddr{IP: net.ParseIP("103.224.182.245"), Port: 23456}
+	c := VPNState{
+		remoteList: []*net.UDPAddr{prague, berlin},
+		// berlin has noBroadcast
+		bcastList: []*net.UDPAddr{prague},
+		extRemotes: map[[4]byte]*net.UDPAddr{
+			{46, 234, 105, 229}:  prague,
+			{103, 224, 182, 245}: berlin,
+		},
+	}
+
+	// frame from 02:00:00:00:00:01 received from berlin (from random port)
+	frame := make([]byte, ethHeaderLen)
+	copy(frame[6:12], []byte{2, 0, 0, 0, 0, 1})
+	c.learnFrame(frame, &net.UDPAddr{IP: berlin.IP, Port: 40000})
+
+	tests := []struct {
+		name string
+		dst  []byte
+		want *net.UDPAddr
+	}{
+		{
+			name: "learned",
+			dst:  []byte{2, 0, 0, 0, 0, 1},
+			want: berlin,
+		},
+		{
+			name: "unknown",
+			dst:  []byte{2, 0, 0, 0, 0, 2},
+			want: prague,
+		},
+		{
+			name: "broadcast",
+			dst:  []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			want: prague,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := make([]byte, ethHeaderLen)
+			copy(f, tt.dst)
+			got := c.frameDsts(f)
+			if 1 != len(got) || got[0] != tt.want {
+				t.Errorf("VPNState.frameDsts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Encrypted datagrams are carried by Transport selected for each remote in
+// prepare. By default it's UDP, for networks where UDP is blocked they can be
+// sent over TCP (or TLS) stream with 2 bytes length prefix. Stream connection (dialed or accepted) is used in both directions.
+// Senders never wait for network: connection is dialed in background (with
+// backoff after failure), datagrams are queued to writer of connection and
+// dropped while there is no connection or its queue is full.
+
+const (
+	transportUDP = "udp"
+	transportTCP = "tcp"
+	transportTLS = "tls"
+
+	// streamTimeout is timeout for dial and write of stream transport
+	streamTimeout = 5 * time.Second
+
+	// streamQueueLen is number of datagrams waiting for write to connection
+	streamQueueLen = 256
+
+	// streamBackoff is delay after first failed dial, it's doubled after
+	// each next failure up to streamMaxBackoff
+	streamBackoff    = time.Second
+	streamMaxBackoff = time.Minute
+)
+
+var eFrameTooBig = errors.New("Frame is too big")
+
+// Transport carries encrypted datagrams between peers, received datagrams
+// are passed to handleIncoming
+type Transport interface {
+	// Send sends datagram to remote addr, conn is UDP socket of calling
+	// sender and paths are paths of multipath remote to be used
+	Send(c *VPNState, conn *net.UDPConn, data []byte, addr *net.UDPAddr, paths []pathInfo) error
+	// Apply starts, stops or changes receiving according to config
+	Apply(c *VPNState) error
+}
+
+// registeredTransports are all transports by name, filled in init
+var registeredTransports = map[string]Transport{}
+
+// validTransport returns true if name is known transport
+func validTransport(name string) bool {
+	_, ok := registeredTransports[name]
+	return "" == name || ok
+}
+
+// transportByName returns transport of given name, UDP by default
+func transportByName(name string) Transport {
+	if t, ok := registeredTransports[name]; ok {
+		return t
+	}
+	return registeredTransports[transportUDP]
+}
+
+// udpTransport sends datagrams by UDP socket of sender (or sockets of bind
+// addresses of multipath), it receives by threads of workerSet
+type udpTransport struct{}
+
+func (udpTransport) Send(c *VPNState, conn *net.UDPConn, data []byte, addr *net.UDPAddr, paths []pathInfo) error {
+	if 0 == len(paths) {
+		_, err := conn.WriteToUDP(data, addr)
+		return err
+	}
+
+	var result error
+	for _, path := range paths {
+		pc := conn
+		if "" != path.bind {
+			if bc := bindConn(path.bind); nil != bc {
+				pc = bc
+			}
+		}
+		if _, err := pc.WriteToUDP(data, path.addr); nil != err {
+			result = err
+			continue
+		}
+		atomic.AddUint64(&path.state.sent, 1)
+	}
+	return result
+}
+
+func (udpTransport) Apply(c *VPNState) error {
+	if w := workers.Load(); nil != w {
+		return w.apply(c)
+	}
+	return nil
+}
+
+// sendTo sends encrypted datagram to remote using its transport
+// (obfuscated if enabled for remote)
+func (c *VPNState) sendTo(conn *net.UDPConn, data []byte, addr *net.UDPAddr) (int, error) {
+	return c.sendPaths(conn, data, addr, nil)
+}
+
+// sendPaths is sendTo using given paths of multipath remote (nil means
+// paths selected by multipath mode)
+func (c *VPNState) sendPaths(conn *net.UDPConn, data []byte, addr *net.UDPAddr, paths []pathInfo) (int, error) {
+	p, ok := c.peers[addr]
+	if !ok {
+		if err := transportByName(transportUDP).Send(c, conn, data, addr, nil); nil != err {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	size := len(data)
+	if p.acct.isBlocked() {
+		// remote exceeded quota
+		c.captureDatagram(captureOut, addr, data, "quota")
+		return size, nil
+	}
+	p.acct.addOut(size)
+	c.captureDatagram(captureOut, addr, data, "")
+
+	if p.obfuscate {
+		buf := obfsBuffers.Get().(*[]byte)
+		defer obfsBuffers.Put(buf)
+		data = (*buf)[:obfuscate(c.Main.obfs, data, *buf)]
+		if 0 == len(data) {
+			return 0, eFrameTooBig
+		}
+	}
+
+	if nil == paths && 0 != len(p.paths) {
+		paths = p.selectPaths()
+	}
+	if err := p.transport.Send(c, conn, data, addr, paths); nil != err {
+		return 0, err
+	}
+	return size, nil
+}
+
+// directUDP returns true if datagrams to addr are written to UDP socket
+// as is (not obfuscated, not sent by stream transport or multiple paths)
+func (c *VPNState) directUDP(addr *net.UDPAddr) bool {
+	if p, ok := c.peers[addr]; ok {
+		_, udp := p.transport.(udpTransport)
+		return udp && !p.obfuscate && 0 == len(p.paths)
+	}
+	return true
+}
+
+// streamConn is one TCP (or TLS) connection to remote
+type streamConn struct {
+	conn  net.Conn
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+// streamDial is state of dialing to remote
+type streamDial struct {
+	active  bool
+	next    time.Time
+	backoff time.Duration
+}
+
+var streamStats struct {
+	dropped uint64
+}
+
+// streamTransport sends length prefixed datagrams over TCP or TLS
+type streamTransport struct {
+	sync.Mutex
+	name  string
+	port  func(c *VPNState) int
+	dial  func(addr string) (net.Conn, error)
+	conns map[[4]byte]*streamConn
+	dials map[[4]byte]*streamDial
+	iface tunIface
+
+	// listener on lnPort, opened by Apply
+	ln       net.Listener
+	lnPort   int
+	listenOn func(port int) (net.Listener, error)
+	// configure is called by Apply before listener is opened
+	configure func(c *VPNState) error
+}
+
+func newStreamTransport(name string, iface tunIface) *streamTransport {
+	return &streamTransport{
+		name:  name,
+		conns: map[[4]byte]*streamConn{},
+		dials: map[[4]byte]*streamDial{},
+		iface: iface,
+	}
+}
+
+// Send queues datagram to connection to addr, without connection it's
+// dialed in background and datagram is dropped (paths are not used)
+func (t *streamTransport) Send(c *VPNState, conn *net.UDPConn, data []byte, addr *net.UDPAddr, paths []pathInfo) error {
+	if len(data) > 0xffff {
+		return eFrameTooBig
+	}
+	key, ok := extKey(addr)
+	if !ok {
+		return fmt.Errorf("%s transport supports only IPv4 remotes", t.name)
+	}
+
+	t.Lock()
+	sc, ok := t.conns[key]
+	if !ok {
+		t.startDial(key, net.JoinHostPort(addr.IP.String(), strconv.Itoa(t.port(c))))
+	}
+	t.Unlock()
+	if !ok {
+		atomic.AddUint64(&streamStats.dropped, 1)
+		return nil
+	}
+
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	select {
+	case sc.queue <- frame:
+	default:
+		atomic.AddUint64(&streamStats.dropped, 1)
+	}
+	return nil
+}
+
+// startDial dials addr in background if it isn't dialed already and
+// backoff after last failure is elapsed, t must be locked
+func (t *streamTransport) startDial(key [4]byte, addr string) {
+	d, ok := t.dials[key]
+	if !ok {
+		d = &streamDial{}
+		t.dials[key] = d
+	}
+	if d.active || time.Now().Before(d.next) {
+		return
+	}
+	d.active = true
+
+	go func() {
+		conn, err := t.dial(addr)
+
+		t.Lock()
+		d.active = false
+		if nil != err {
+			d.backoff *= 2
+			if d.backoff < streamBackoff {
+				d.backoff = streamBackoff
+			} else if d.backoff > streamMaxBackoff {
+				d.backoff = streamMaxBackoff
+			}
+			d.next = time.Now().Add(d.backoff)
+			backoff := d.backoff
+			t.Unlock()
+			log.Printf("%s connection to %s failed: %s, next try in %s\n", t.name, addr, err, backoff)
+			return
+		}
+		d.backoff = 0
+		t.Unlock()
+
+		log.Printf("%s connection to %s established\n", t.name, conn.RemoteAddr())
+		t.register(key, conn)
+	}()
+}
+
+// register starts reading from and writing to connection and uses it
+// for sending
+func (t *streamTransport) register(key [4]byte, conn net.Conn) *streamConn {
+	sc := &streamConn{
+		conn:  conn,
+		queue: make(chan []byte, streamQueueLen),
+		done:  make(chan struct{}),
+	}
+
+	t.Lock()
+	if old, ok := t.conns[key]; ok {
+		// keep reading from old one until it fails
+		log.Printf("Replacing %s connection to %s\n", t.name, old.conn.RemoteAddr())
+	}
+	t.conns[key] = sc
+	t.Unlock()
+
+	go t.serve(key, sc)
+	go t.write(key, sc)
+	return sc
+}
+
+func (t *streamTransport) unregister(key [4]byte, sc *streamConn) {
+	t.Lock()
+	if t.conns[key] == sc {
+		delete(t.conns, key)
+	}
+	t.Unlock()
+	sc.once.Do(func() {
+		close(sc.done)
+		sc.conn.Close()
+	})
+}
+
+// write writes queued datagrams to connection
+func (t *streamTransport) write(key [4]byte, sc *streamConn) {
+	for {
+		select {
+		case frame := <-sc.queue:
+			sc.conn.SetWriteDeadline(time.Now().Add(streamTimeout))
+			if _, err := sc.conn.Write(frame); nil != err {
+				log.Printf("%s connection to %s failed: %s\n", t.name, sc.conn.RemoteAddr(), err)
+				t.unregister(key, sc)
+				return
+			}
+		case <-sc.done:
+			return
+		}
+	}
+}
+
+// serve reads datagrams from connection and handles them as received by UDP
+func (t *streamTransport) serve(key [4]byte, sc *streamConn) {
+	defer t.unregister(key, sc)
+
+	from := &net.UDPAddr{IP: net.IPv4(key[0], key[1], key[2], key[3])}
+	hdr := make([]byte, 2)
+	encrypted := make([]byte, BUFFERSIZE)
+	var decrypted IPPacket = make([]byte, BUFFERSIZE)
+
+	for {
+		if _, err := io.ReadFull(sc.conn, hdr); nil != err {
+			if io.EOF != err {
+				log.Printf("%s connection to %s failed: %s\n", t.name, sc.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		n := int(binary.BigEndian.Uint16(hdr))
+		if n > len(encrypted) {
+			log.Printf("%s connection to %s: %s\n", t.name, sc.conn.RemoteAddr(), eFrameTooBig)
+			return
+		}
+		if _, err := io.ReadFull(sc.conn, encrypted[:n]); nil != err {
+			log.Printf("%s connection to %s failed: %s\n", t.name, sc.conn.RemoteAddr(), err)
+			return
+		}
+		if 0 == n {
+			continue
+		}
+
+		conf := config.Load().(VPNState)
+		handleIncoming(&conf, from, encrypted[:n], decrypted, t.iface)
+		flushIface(t.iface)
+	}
+}
+
+// listen accepts connections from known remotes
+func (t *streamTransport) listen(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if nil != err {
+			log.Printf("Error accepting %s connection: %s\n", t.name, err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		conf := config.Load().(VPNState)
+		key, ok := extKey(&net.UDPAddr{IP: conn.RemoteAddr().(*net.TCPAddr).IP})
+		if _, known := conf.extRemotes[key]; !ok || !known {
+			log.Printf("%s connection from unknown remote %s\n", t.name, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		log.Printf("%s connection from %s accepted\n", t.name, conn.RemoteAddr())
+		t.register(key, conn)
+	}
+}
+
+// Apply opens listener on new port (and closes old one), without port
+// listener and all connections are closed
+func (t *streamTransport) Apply(c *VPNState) error {
+	if nil != t.configure {
+		if err := t.configure(c); nil != err {
+			return err
+		}
+	}
+
+	port := t.port(c)
+	if port < 0 {
+		port = 0
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if port == t.lnPort {
+		return nil
+	}
+
+	var ln net.Listener
+	if port > 0 {
+		var err error
+		if ln, err = t.listenOn(port); nil != err {
+			return fmt.Errorf("unable to listen on %s port: %s", t.name, err)
+		}
+		go t.listen(ln)
+	}
+
+	if nil != t.ln {
+		t.ln.Close()
+	}
+	t.ln, t.lnPort = ln, port
+
+	if 0 == port {
+		for _, sc := range t.conns {
+			sc.conn.Close()
+		}
+	}
+	return nil
+}
+
+// newTCPTransport returns tcp transport listening on main.tcpPort
+func newTCPTransport() *streamTransport {
+	dialer := &net.Dialer{Timeout: streamTimeout}
+
+	t := newStreamTransport(transportTCP, nil)
+	t.port = func(c *VPNState) int { return c.Main.TCPPort }
+	t.dial = func(addr string) (net.Conn, error) {
+		return dialer.Dial("tcp4", addr)
+	}
+	t.listenOn = func(port int) (net.Listener, error) {
+		return net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	}
+	return t
+}
+
+// newTLSTransport returns tls transport listening on main.tlsPort, TLS
+// config is reloaded by Apply so new connections use changed certificates
+func newTLSTransport() *streamTransport {
+	dialer := &net.Dialer{Timeout: streamTimeout}
+	var tlsConf atomic.Pointer[tls.Config]
+
+	t := newStreamTransport(transportTLS, nil)
+	t.port = func(c *VPNState) int { return c.Main.TLSPort }
+	t.dial = func(addr string) (net.Conn, error) {
+		return tls.DialWithDialer(dialer, "tcp4", addr, tlsConf.Load())
+	}
+	t.listenOn = func(port int) (net.Listener, error) {
+		ln, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+		if nil != err {
+			return nil, err
+		}
+		return tls.NewListener(ln, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return tlsConf.Load(), nil
+			},
+		}), nil
+	}
+	t.configure = func(c *VPNState) error {
+		if c.Main.TLSPort <= 0 {
+			return nil
+		}
+		conf, err := transportTLSConfig(c)
+		if nil != err {
+			return fmt.Errorf("unable to configure TLS: %s", err)
+		}
+		tlsConf.Store(conf)
+		return nil
+	}
+	return t
+}
+
+// initTransports sets local interface for datagrams received by stream
+// transports, it's called before transports are applied
+func initTransports(iface tunIface) {
+	for _, t := range registeredTransports {
+		if st, ok := t.(*streamTransport); ok {
+			st.iface = iface
+		}
+	}
+}
+
+// applyTransports applies config to all transports: workers of UDP are
+// updated, listeners of stream transports follow tcpPort/tlsPort and TLS
+// files, existing connections are kept while their port is configured
+func applyTransports(c *VPNState) error {
+	var errs []error
+	for _, t := range registeredTransports {
+		if err := t.Apply(c); nil != err {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// transportTLSConfig returns TLS config for both client and server side,
+// without tlsca server certificate is not verified (datagrams are encrypted
+// and authenticated by lcvpn itself, TLS is used to pass firewalls)
+func transportTLSConfig(conf *VPNState) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.Main.TLSCert, conf.Main.TLSKey)
+	if nil != err {
+		return nil, err
+	}
+
+	tlsConf := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: "" == conf.Main.TLSCA,
+	}
+
+	if "" != conf.Main.TLSCA {
+		pem, err := os.ReadFile(conf.Main.TLSCA)
+		if nil != err {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in tlsca")
+		}
+		tlsConf.RootCAs = pool
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConf.ServerName = conf.Main.TLSServerName
+	}
+
+	return tlsConf, nil
+}
+
+func streamStatistics() string {
+	n := 0
+	for _, t := range registeredTransports {
+		if st, ok := t.(*streamTransport); ok {
+			st.Lock()
+			n += len(st.conns)
+			st.Unlock()
+		}
+	}
+	return fmt.Sprintf("%d connections, %d dropped", n, atomic.LoadUint64(&streamStats.dropped))
+}
+
+func init() {
+	registeredTransports[transportUDP] = udpTransport{}
+	registeredTransports[transportTCP] = newTCPTransport()
+	registeredTransports[transportTLS] = newTLSTransport()
+	registeredStats["stream"] = streamStatistics
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerTransport(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		local   string
+		remote  string
+		tcpPort int
+		tlsPort int
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: ""},
+		{name: "udp", main: "udp", want: ""},
+		{name: "main", main: "tcp", tcpPort: 8443, want: "tcp"},
+		{name: "remote", remote: "TCP", tcpPort: 8443, want: "tcp"},
+		{name: "local", local: "tcp", remote: "udp", tcpPort: 8443, want: "tcp"},
+		{name: "tls preferred", main: "tcp", remote: "tls", tcpPort: 8443, tlsPort: 443, want: "tls"},
+		{name: "no port", remote: "tcp", wantErr: true},
+		{name: "no cert", remote: "tls", tlsPort: 443, wantErr: true},
+		{name: "unknown", remote: "sctp", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c VPNState
+			c.Main.Transport = tt.main
+			c.Main.TCPPort = tt.tcpPort
+			c.Main.TLSPort = tt.tlsPort
+			if "tls" == tt.want {
+				c.Main.TLSCert, c.Main.TLSKey = "cert.pem", "key.pem"
+			}
+			got, err := c.peerTransport(tt.local, tt.remote)
+			if (nil != err) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("transport = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransportByName(t *testing.T) {
+	for _, name := range []string{"", transportUDP, "unknown"} {
+		if _, ok := transportByName(name).(udpTransport); !ok {
+			t.Errorf("transport %q is not udp", name)
+		}
+	}
+	for _, name := range []string{transportTCP, transportTLS} {
+		if st, ok := transportByName(name).(*streamTransport); !ok || name != st.name {
+			t.Errorf("transport %q is not stream transport", name)
+		}
+	}
+}
+
+func TestStreamSendDoesNotBlock(t *testing.T) {
+	dials := make(chan struct{}, 10)
+	tr := newStreamTransport(transportTCP, idleIface{})
+	tr.port = func(c *VPNState) int { return 1 }
+	tr.dial = func(addr string) (net.Conn, error) {
+		dials <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		return nil, errors.New("unreachable")
+	}
+
+	var c VPNState
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := tr.Send(&c, nil, []byte("data"), addr, nil); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("Send waits for dial")
+	}
+
+	<-dials
+	time.Sleep(200 * time.Millisecond)
+	// failed dial isn't repeated before backoff elapses
+	tr.Send(&c, nil, []byte("data"), addr, nil)
+	time.Sleep(50 * time.Millisecond)
+	if 0 != len(dials) {
+		t.Error("dial repeated during backoff")
+	}
+}
+
+func TestStreamSendConnected(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := newStreamTransport(transportTCP, idleIface{})
+	tr.port = func(c *VPNState) int { return ln.Addr().(*net.TCPAddr).Port }
+	tr.dial = func(addr string) (net.Conn, error) { return net.Dial("tcp4", addr) }
+
+	var c VPNState
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	tr.Send(&c, nil, []byte("dropped"), addr, nil)
+
+	conn, err := ln.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// wait for connection to be registered
+	for i := 0; ; i++ {
+		tr.Lock()
+		_, ok := tr.conns[[4]byte{127, 0, 0, 1}]
+		tr.Unlock()
+		if ok {
+			break
+		}
+		if i > 100 {
+			t.Fatal("connection not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := tr.Send(&c, nil, []byte("data"), addr, nil); nil != err {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{0, 4, 'd', 'a', 't', 'a'}) {
+		t.Errorf("got frame %v", buf)
+	}
+}
+
+func TestStreamApply(t *testing.T) {
+	config.Store(VPNState{})
+
+	tr := newStreamTransport(transportTCP, idleIface{})
+	tr.port = func(c *VPNState) int { return c.Main.TCPPort }
+	tr.listenOn = func(port int) (net.Listener, error) {
+		return net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	}
+	accepting := func(port int) bool {
+		conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+		if nil != err {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	var c VPNState
+	c.Main.TCPPort = freePort(t)
+	if err := tr.Apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	old := c.Main.TCPPort
+	if !accepting(old) {
+		t.Fatal("listener not opened")
+	}
+
+	c.Main.TCPPort = freePort(t)
+	if err := tr.Apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	if !accepting(c.Main.TCPPort) || accepting(old) {
+		t.Error("listener not moved to new port")
+	}
+
+	port := c.Main.TCPPort
+	c.Main.TCPPort = 0
+	if err := tr.Apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	if nil != tr.ln || accepting(port) {
+		t.Error("listener not closed")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// With main.watchConfig config file, included files, files of peersDir
+// and TLS files are watched (inotify on linux) and config is reloaded when
+// they are changed, reload is started after changes settle down
+
+// configWatchDelay is time without changes before reload
+const configWatchDelay = 500 * time.Millisecond
+
+// configWatched returns patterns of files changes of which trigger reload
+func configWatched(file string, c *VPNState) []string {
+	watched := []string{filepath.Clean(file)}
+	for _, pattern := range c.Main.Include {
+		watched = append(watched, configPath(file, pattern))
+	}
+	if "" != c.Main.PeersDir {
+		exts := []string{".conf"}
+		for ext := range registeredLoaders {
+			exts = append(exts, ext)
+		}
+		sort.Strings(exts)
+		for _, ext := range exts {
+			watched = append(watched, filepath.Join(configPath(file, c.Main.PeersDir), "*"+ext))
+		}
+	}
+	for _, f := range []string{c.Main.TLSCert, c.Main.TLSKey, c.Main.TLSCA} {
+		if "" != f {
+			watched = append(watched, filepath.Clean(f))
+		}
+	}
+	return watched
+}
+
+// isWatched returns true if change of file path should trigger reload
+func (c *VPNState) isWatched(path string) bool {
+	for _, pattern := range c.watched {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// watchedDirs returns directories which contain watched files
+func (c *VPNState) watchedDirs() []string {
+	var dirs []string
+	seen := map[string]bool{}
+	for _, pattern := range c.watched {
+		dir := filepath.Dir(pattern)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,12 @@
+// +build darwin
+
+package main
+
+import "log"
+
+// configWatchThread is not implemented, config is reloaded only by signal
+func configWatchThread(routeReload chan bool) {
+	if config.Load().(VPNState).Main.WatchConfig {
+		log.Println("Config watching is supported only on linux")
+	}
+}
@@ -0,0 +1,104 @@
+// +build linux
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const configWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_CREATE | syscall.IN_DELETE
+
+// configWatcher watches directories of config files with inotify
+// (files are often replaced by rename, so directories are watched)
+type configWatcher struct {
+	sync.Mutex
+	fd   int
+	dirs map[int]string
+	wds  map[string]int
+}
+
+// update adds watches for directories of current config
+func (w *configWatcher) update(c *VPNState) {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, dir := range c.watchedDirs() {
+		if _, ok := w.wds[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, configWatchMask)
+		if nil != err {
+			log.Println("Unable to watch", dir+":", err)
+			continue
+		}
+		w.wds[dir] = wd
+		w.dirs[wd] = dir
+	}
+}
+
+// read sends paths of changed files to events
+func (w *configWatcher) read(events chan<- string) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if nil != err {
+			if syscall.EINTR == err {
+				continue
+			}
+			log.Println("Config watching failed:", err)
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+int(ev.Len)]), "\x00")
+			off += int(ev.Len)
+
+			w.Lock()
+			dir, ok := w.dirs[int(ev.Wd)]
+			w.Unlock()
+			if ok && "" != name {
+				events <- filepath.Join(dir, name)
+			}
+		}
+	}
+}
+
+// configWatchThread reloads config when watched files are changed
+func configWatchThread(routeReload chan bool) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if nil != err {
+		log.Println("Unable to watch config:", err)
+		return
+	}
+	w := &configWatcher{fd: fd, dirs: map[int]string{}, wds: map[string]int{}}
+	events := make(chan string, 64)
+	go w.read(events)
+
+	var timer <-chan time.Time
+	for {
+		c := config.Load().(VPNState)
+		if c.Main.WatchConfig {
+			w.update(&c)
+		}
+
+		select {
+		case path := <-events:
+			if c.Main.WatchConfig && c.isWatched(path) {
+				timer = time.After(configWatchDelay)
+			}
+		case <-timer:
+			timer = nil
+			reloadConfig(routeReload, "file changed")
+		case <-configReloaded:
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/matishsiao/go_reuseport"
+)
+
+// Receiver and sender threads are managed by workerSet, so changes of
+// main.port, recvThreads, sendThreads, bind addresses and local address are
+// applied on config reload without restart. Each receiver has own socket
+// (SO_REUSEPORT), on port change new sockets are opened before old ones are
+// closed. Bind addresses of multipath get own sockets on main port which are
+// read by own receivers too. Sender blocked in read from interface exits
+// after next packet.
+//
+// In multiqueue mode each sender reads own queue of interface, queue is
+// opened when sender is started and closed (so detached from interface)
+// when it's stopped, because kernel would still put flows to queue nobody
+// reads. Receivers only write, so they use any of currently open queues.
+
+type workerSet struct {
+	sync.Mutex
+	writeConn *net.UDPConn
+	queues    []tunIface
+	openQueue func() (tunIface, error)
+	active    atomic.Pointer[[]tunIface]
+	ifaceName string
+	bridge    bool
+
+	port      int
+	local     string
+	receivers []net.PacketConn
+	senders   []*atomic.Bool
+	binds     map[string]*net.UDPConn
+}
+
+var workers atomic.Pointer[workerSet]
+
+// newWorkerSet returns workers for interface queues, openQueue opens next
+// queue of multiqueue interface (nil without multiqueue)
+func newWorkerSet(writeConn *net.UDPConn, queues []tunIface, openQueue func() (tunIface, error), c *VPNState) *workerSet {
+	return &workerSet{
+		writeConn: writeConn,
+		queues:    queues,
+		openQueue: openQueue,
+		ifaceName: queues[0].Name(),
+		bridge:    "" != c.Main.Bridge,
+		local:     c.Main.local,
+	}
+}
+
+// queueWriter writes to i-th (modulo count) of currently open queues
+type queueWriter struct {
+	w *workerSet
+	i int
+}
+
+func (q queueWriter) queue() tunIface {
+	queues := *q.w.active.Load()
+	return queues[q.i%len(queues)]
+}
+
+func (q queueWriter) Read([]byte) (int, error)    { return 0, errors.New("receiver queue is write only") }
+func (q queueWriter) Write(b []byte) (int, error) { return q.queue().Write(b) }
+func (q queueWriter) Close() error                { return nil }
+func (q queueWriter) Name() string                { return q.w.ifaceName }
+
+func (q queueWriter) Flush() error {
+	if f, ok := q.queue().(ifaceFlusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// receiverQueue returns interface for i-th receiver
+func (w *workerSet) receiverQueue(i int) tunIface {
+	return queueWriter{w: w, i: i}
+}
+
+// publishQueues makes current queues available to receivers
+func (w *workerSet) publishQueues() {
+	queues := append([]tunIface{}, w.queues...)
+	w.active.Store(&queues)
+}
+
+// listenUDP opens socket for receiver thread on local address ip ("" means
+// any address)
+func listenUDP(ip string, port int) (net.PacketConn, error) {
+	return reuseport.NewReusableUDPPortConn("udp4", fmt.Sprintf("%s:%v", ip, port))
+}
+
+// apply starts and stops threads, rebinds sockets and changes interface
+// address according to config
+func (w *workerSet) apply(c *VPNState) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if nil == w.active.Load() {
+		w.publishQueues()
+	}
+
+	var err error
+	oldPort := w.port
+	if c.Main.Port != w.port {
+		err = w.rebind(c.Main.Port, c.Main.RecvThreads)
+	} else {
+		err = w.setReceivers(c.Main.RecvThreads)
+	}
+
+	w.setSenders(c.Main.SendThreads)
+	w.setBinds(c.Main.binds, oldPort != w.port)
+
+	if c.Main.local != w.local && !w.bridge {
+		if aerr := ifaceSetAddress(w.ifaceName, w.local, c.Main.local); nil != aerr {
+			log.Println("Unable to change interface address to", c.Main.local+":", aerr)
+		} else {
+			log.Println("Interface address changed from", w.local, "to", c.Main.local)
+			w.local = c.Main.local
+		}
+	}
+
+	return err
+}
+
+// rebind starts n receivers on new port and then stops old ones,
+// old receivers are kept if new port can't be opened
+func (w *workerSet) rebind(port, n int) error {
+	conns := make([]net.PacketConn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := listenUDP("", port)
+		if nil != err {
+			for _, c := range conns {
+				c.Close()
+			}
+			return fmt.Errorf("unable to listen on port %d: %s", port, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	for i, conn := range conns {
+		go rcvrThread(conn, w.receiverQueue(i))
+	}
+	for _, conn := range w.receivers {
+		conn.Close()
+	}
+	if 0 != w.port {
+		log.Println("Listening port changed from", w.port, "to", port)
+	}
+	w.receivers = conns
+	w.port = port
+	return nil
+}
+
+// setReceivers starts or stops receivers to have n of them
+func (w *workerSet) setReceivers(n int) error {
+	for len(w.receivers) < n {
+		conn, err := listenUDP("", w.port)
+		if nil != err {
+			return fmt.Errorf("unable to listen on port %d: %s", w.port, err)
+		}
+		go rcvrThread(conn, w.receiverQueue(len(w.receivers)))
+		w.receivers = append(w.receivers, conn)
+	}
+	for len(w.receivers) > n {
+		last := len(w.receivers) - 1
+		w.receivers[last].Close()
+		w.receivers = w.receivers[:last]
+	}
+	return nil
+}
+
+// setSenders starts or stops senders to have n of them, in multiqueue
+// mode each sender gets own queue
+func (w *workerSet) setSenders(n int) {
+	for len(w.senders) < n {
+		i := len(w.senders)
+		if i >= len(w.queues) && nil != w.openQueue {
+			if q, err := w.openQueue(); nil != err {
+				log.Println("Unable to open queue", i, "of interface", w.ifaceName+":", err)
+			} else {
+				w.queues = append(w.queues, q)
+			}
+		}
+		stop := &atomic.Bool{}
+		go sndrThread(w.writeConn, w.queues[i%len(w.queues)], stop)
+		w.senders = append(w.senders, stop)
+	}
+	for len(w.senders) > n {
+		last := len(w.senders) - 1
+		w.senders[last].Store(true)
+		w.senders = w.senders[:last]
+	}
+
+	// queue without sender is closed, receivers stop using it first
+	keep := len(w.senders)
+	if keep < 1 {
+		keep = 1
+	}
+	var removed []tunIface
+	if keep < len(w.queues) {
+		removed = w.queues[keep:]
+		w.queues = w.queues[:keep:keep]
+	}
+	w.publishQueues()
+	for _, q := range removed {
+		flushIface(q)
+		if err := q.Close(); nil != err {
+			log.Println("Unable to close queue of interface", w.ifaceName+":", err)
+		}
+	}
+	if 0 != len(removed) {
+		log.Println("Interface", w.ifaceName, "has", len(w.queues), "queues")
+	}
+}
+
+// setBinds opens sockets of bind addresses on current port (all of them
+// are reopened if port is changed) and closes sockets of removed ones
+func (w *workerSet) setBinds(ips []string, reopen bool) {
+	binds := make(map[string]*net.UDPConn, len(ips))
+	for _, ip := range ips {
+		if conn, ok := w.binds[ip]; ok && !reopen {
+			binds[ip] = conn
+			continue
+		}
+		pc, err := listenUDP(ip, w.port)
+		if nil != err {
+			log.Println("Unable to bind", ip+":", err)
+			continue
+		}
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			log.Println("Unable to bind", ip+": not UDP socket")
+			continue
+		}
+		go rcvrThread(conn, w.receiverQueue(len(binds)))
+		binds[ip] = conn
+	}
+	bindConns.Store(&binds)
+
+	for ip, conn := range w.binds {
+		if binds[ip] != conn {
+			conn.Close()
+		}
+	}
+	w.binds = binds
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type idleIface struct{}
+
+func (idleIface) Read([]byte) (int, error)  { select {} }
+func (idleIface) Write([]byte) (int, error) { return 0, nil }
+func (idleIface) Close() error              { return nil }
+func (idleIface) Name() string              { return "idle0" }
+
+func freePort(t *testing.T) int {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestWorkerSetApply(t *testing.T) {
+	config.Store(VPNState{})
+
+	w := &workerSet{queues: []tunIface{idleIface{}}, ifaceName: "idle0"}
+	closed := func(conn net.PacketConn) bool {
+		return nil != conn.SetReadDeadline(time.Time{})
+	}
+
+	var c VPNState
+	c.Main.Port = freePort(t)
+	c.Main.RecvThreads = 3
+	if err := w.apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	if 3 != len(w.receivers) || c.Main.Port != w.port {
+		t.Fatalf("got %d receivers on port %d", len(w.receivers), w.port)
+	}
+	old := append([]net.PacketConn{}, w.receivers...)
+
+	c.Main.RecvThreads = 1
+	if err := w.apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(w.receivers) || closed(old[0]) || !closed(old[1]) || !closed(old[2]) {
+		t.Fatalf("receivers not stopped: %d left", len(w.receivers))
+	}
+
+	c.Main.Port = freePort(t)
+	c.Main.RecvThreads = 2
+	if err := w.apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(w.receivers) || !closed(old[0]) {
+		t.Fatalf("got %d receivers, old closed %v", len(w.receivers), closed(old[0]))
+	}
+	for _, conn := range w.receivers {
+		if port := conn.LocalAddr().(*net.UDPAddr).Port; port != c.Main.Port {
+			t.Errorf("receiver listens on %d, want %d", port, c.Main.Port)
+		}
+		conn.Close()
+	}
+}
+
+func TestWorkerSetBinds(t *testing.T) {
+	config.Store(VPNState{})
+	defer bindConns.Store(nil)
+
+	w := &workerSet{queues: []tunIface{idleIface{}}, ifaceName: "idle0"}
+	var c VPNState
+	c.Main.Port = freePort(t)
+	c.Main.RecvThreads = 1
+	c.Main.binds = []string{"127.0.0.1"}
+	if err := w.apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	old := bindConn("127.0.0.1")
+	if nil == old || c.Main.Port != old.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatal("bind socket not opened on main port")
+	}
+
+	c.Main.Port = freePort(t)
+	if err := w.apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	conn := bindConn("127.0.0.1")
+	if nil == conn || conn == old || c.Main.Port != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatal("bind socket not reopened on new port")
+	}
+	if nil == old.SetReadDeadline(time.Time{}) {
+		t.Error("old bind socket not closed")
+	}
+
+	c.Main.binds = nil
+	if err := w.apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	if nil != bindConn("127.0.0.1") || nil == conn.SetReadDeadline(time.Time{}) {
+		t.Error("removed bind socket not closed")
+	}
+	for _, r := range w.receivers {
+		r.Close()
+	}
+}
+
+type countIface struct {
+	idleIface
+	closed *int
+}
+
+func (i countIface) Close() error {
+	*i.closed++
+	return nil
+}
+
+func TestWorkerSetQueues(t *testing.T) {
+	e, err := newAesCbc("4A34E352D7C32FC42F1CEB0CAA54D40E")
+	if nil != err {
+		t.Fatal(err)
+	}
+	var c VPNState
+	// senders started by apply need encrypter
+	c.Main.main = e
+	config.Store(c)
+
+	opened, closed := 0, 0
+	w := &workerSet{queues: []tunIface{idleIface{}}, ifaceName: "idle0"}
+	w.openQueue = func() (tunIface, error) {
+		opened++
+		return countIface{closed: &closed}, nil
+	}
+
+	c.Main.Port = freePort(t)
+	c.Main.RecvThreads = 4
+	c.Main.SendThreads = 3
+	if err := w.apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	if 3 != len(w.queues) || 2 != opened || 3 != len(*w.active.Load()) {
+		t.Fatalf("got %d queues (%d opened) for 3 senders", len(w.queues), opened)
+	}
+	if q := w.receiverQueue(3).(queueWriter).queue(); q != w.queues[0] {
+		t.Error("receiver doesn't write to open queue")
+	}
+
+	// queues of stopped senders are closed and not used by receivers
+	c.Main.SendThreads = 1
+	if err := w.apply(&c); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(w.queues) || 2 != closed || 1 != len(*w.active.Load()) {
+		t.Fatalf("got %d queues (%d closed) for 1 sender", len(w.queues), closed)
+	}
+	for i := range w.receivers {
+		if q := w.receiverQueue(i).(queueWriter).queue(); q != w.queues[0] {
+			t.Errorf("receiver %d writes to closed queue", i)
+		}
+	}
+	for _, r := range w.receivers {
+		r.Close()
+	}
+}